@@ -27,7 +27,23 @@ func NewApp() *App {
 // ,so we can call the runtime methods
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
-	backend.InitDB()
+	backend.Subscribe(wailsPublisher{ctx: ctx}, nil)
+
+	settings, err := loadSettings()
+	if err != nil {
+		fmt.Println("Error loading settings:", err)
+	}
+	settings.apply()
+
+	err = backend.StartSession(ctx)
+	if err != nil {
+		fmt.Println("Error resuming torrents:", err)
+	}
+}
+
+// shutdown is called when the app is closing
+func (a *App) shutdown(ctx context.Context) {
+	backend.Shutdown()
 }
 
 func (a *App) OpenFileDialog() *backend.Torrent {
@@ -51,8 +67,8 @@ func (a *App) OpenFileDialog() *backend.Torrent {
 		panic(err)
 	}
 
-	backend.NewClient(torrent)
-	return torrent
+	backend.Enqueue(torrent)
+	return torrent.Snapshot()
 }
 
 func (a *App) GetDevTorrent() (*backend.Torrent, error) {
@@ -84,9 +100,158 @@ func (a *App) AddTorrent(t *backend.Torrent) {
 
 // ui is not updating on delete
 func (a *App) RemoveTorrent(id int) {
-	backend.Remove(id)
+	backend.RemoveTorrent(id, false)
 }
 
-func (a *App) GetTorrents() ([]backend.Torrent, error) {
+func (a *App) GetTorrents() ([]*backend.Torrent, error) {
 	return backend.GetTorrents()
 }
+
+// SetFilePriority sets how much a file is wanted: 0 skip, 1 low, 2 normal, 3 high
+func (a *App) SetFilePriority(torrentID, fileIndex, priority int) error {
+	return backend.SetFilePriority(torrentID, fileIndex, backend.FilePriority(priority))
+}
+
+// SetSequential downloads a torrent in order so it can be played while downloading
+func (a *App) SetSequential(torrentID int, sequential bool) error {
+	return backend.SetSequential(torrentID, sequential)
+}
+
+// GetStreamURL returns a localhost URL a media player can open the file at
+func (a *App) GetStreamURL(torrentID, fileIndex int) (string, error) {
+	return backend.StreamURL(torrentID, fileIndex)
+}
+
+func (a *App) GetBandwidthSettings() backend.BandwidthSettings {
+	return backend.GetBandwidthSettings()
+}
+
+// SetBandwidthSettings sets the global limits, in bytes per second with 0
+// meaning unlimited, and the alternative schedule. They're saved for the
+// next start.
+func (a *App) SetBandwidthSettings(settings backend.BandwidthSettings) error {
+	err := backend.SetBandwidthSettings(settings)
+	if err != nil {
+		return err
+	}
+	return updateSettings(func(s *appSettings) { s.Bandwidth = &settings })
+}
+
+func (a *App) SetTorrentBandwidth(torrentID int, downloadLimit, uploadLimit int64) error {
+	return backend.SetTorrentBandwidth(torrentID, downloadLimit, uploadLimit)
+}
+
+func (a *App) PauseTorrent(torrentID int) error {
+	return backend.PauseTorrent(torrentID)
+}
+
+func (a *App) ResumeTorrent(torrentID int) error {
+	return backend.ResumeTorrent(torrentID)
+}
+
+func (a *App) GetQueueSettings() backend.QueueSettings {
+	return backend.GetQueueSettings()
+}
+
+// SetQueueSettings sets how many torrents download and seed at once, 0
+// meaning no limit. They're saved for the next start.
+func (a *App) SetQueueSettings(settings backend.QueueSettings) error {
+	err := backend.SetQueueSettings(settings)
+	if err != nil {
+		return err
+	}
+	return updateSettings(func(s *appSettings) { s.Queue = &settings })
+}
+
+func (a *App) MoveQueueUp(torrentID int) error {
+	return backend.MoveInQueue(torrentID, backend.MoveUp)
+}
+
+func (a *App) MoveQueueDown(torrentID int) error {
+	return backend.MoveInQueue(torrentID, backend.MoveDown)
+}
+
+func (a *App) MoveQueueTop(torrentID int) error {
+	return backend.MoveInQueue(torrentID, backend.MoveTop)
+}
+
+func (a *App) MoveQueueBottom(torrentID int) error {
+	return backend.MoveInQueue(torrentID, backend.MoveBottom)
+}
+
+func (a *App) GetSeedingGoals() backend.SeedingGoals {
+	return backend.GetSeedingGoals()
+}
+
+// SetSeedingGoals sets when torrents stop seeding and what happens to them
+// then. They're saved for the next start.
+func (a *App) SetSeedingGoals(goals backend.SeedingGoals) error {
+	err := backend.SetSeedingGoals(goals)
+	if err != nil {
+		return err
+	}
+	return updateSettings(func(s *appSettings) { s.SeedingGoals = &goals })
+}
+
+// SetTorrentSeedingGoals overrides the global seeding goals, null going back to them
+func (a *App) SetTorrentSeedingGoals(torrentID int, goals *backend.SeedingGoals) error {
+	return backend.SetTorrentSeedingGoals(torrentID, goals)
+}
+
+// GetStats returns the latest stats of every torrent, updates follow as "stats" events
+func (a *App) GetStats() []backend.TorrentStats {
+	return backend.GetStats()
+}
+
+func (a *App) GetConnectionSettings() backend.ConnectionSettings {
+	return backend.GetConnectionSettings()
+}
+
+// SetConnectionSettings caps peer connections globally and per torrent.
+// The caps are saved for the next start.
+func (a *App) SetConnectionSettings(settings backend.ConnectionSettings) error {
+	err := backend.SetConnectionSettings(settings)
+	if err != nil {
+		return err
+	}
+	return updateSettings(func(s *appSettings) { s.Connections = &settings })
+}
+
+func (a *App) GetEncryptionPolicy() string {
+	return backend.GetEncryptionPolicy()
+}
+
+// SetEncryptionPolicy sets peer encryption to "prefer", "require",
+// "tolerate" or "disabled". The policy is saved for the next start.
+func (a *App) SetEncryptionPolicy(policy string) error {
+	err := backend.SetEncryptionPolicy(policy)
+	if err != nil {
+		return err
+	}
+	return updateSettings(func(s *appSettings) { s.Encryption = policy })
+}
+
+func (a *App) GetIPFilter() backend.IPFilterStatus {
+	return backend.GetIPFilter()
+}
+
+// SetIPFilter blocks the ranges of an eMule, PeerGuardian or CIDR list
+// file, possibly gzipped. An empty path turns the filter off. The path is
+// saved so the filter is loaded again on the next start.
+func (a *App) SetIPFilter(path string) error {
+	err := backend.SetIPFilter(path)
+	if err != nil {
+		return err
+	}
+	return updateSettings(func(s *appSettings) { s.IPFilter = path })
+}
+
+// ReloadIPFilter reads the filter file again after it changed
+func (a *App) ReloadIPFilter() error {
+	return backend.ReloadIPFilter()
+}
+
+// GetPeers returns the peers a torrent is connected to
+func (a *App) GetPeers(torrentID int) ([]backend.PeerInfo, error) {
+	return backend.GetPeers(torrentID)
+}
@@ -2,30 +2,74 @@
 package backend
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	client      *Client
-	clientMutex sync.Mutex
+	clients      = make(map[int]*Client)
+	clientsMutex sync.Mutex
 )
 
+// Client downloads and seeds a single torrent
 type Client struct {
 	Torrent  *Torrent
 	Peers    []*Peer
 	Bitfield Bitfield
+	picker   *PiecePicker
+	storage  *Storage
 	mutex    sync.Mutex
+	// pieceDone is signalled every time a piece is verified and stored
+	pieceDone       *sync.Cond
+	downloadLimiter *RateLimiter
+	uploadLimiter   *RateLimiter
+	// ctx is the context of the running session, cancel stops it. Both
+	// are nil while stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// lastUpload is the unix time we last sent a block
+	lastUpload atomic.Int64
+	// wasted counts the bytes of pieces that failed their hash check
+	wasted atomic.Int64
+	// announceKey is sent with every announce of this session
+	announceKey string
+	// swarm size from the last tracker response
+	trackerSeeds    atomic.Int64
+	trackerLeechers atomic.Int64
+	// trackerCompleted asks the tracker loop to announce completed
+	trackerCompleted chan struct{}
+	// trackerDone is closed when the tracker loop of the last run is over
+	trackerDone chan struct{}
+	// candidates are the peers the pool may connect to, by address
+	candidates map[string]*candidate
+	poolWake   chan struct{}
+	// connections counts open and half-open connections, guarded by poolMutex
+	connections int
 }
 
 func NewClient(torrent *Torrent) *Client {
-	clientMutex.Lock()
-	defer clientMutex.Unlock()
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
 
-	client = &Client{
-		Torrent: torrent,
-		Bitfield: NewBitfield([]byte(torrent.bencodeTorrent.Info.Pieces)),
+	numPieces := torrent.bencodeTorrent.NumPieces()
+	current := torrent.Snapshot()
+	cl := &Client{
+		Torrent:          torrent,
+		Bitfield:         NewBitfield(make([]byte, (numPieces+7)/8)),
+		picker:           NewPiecePicker(torrent),
+		storage:          NewStorage(torrent),
+		downloadLimiter:  NewRateLimiter(current.DownloadLimit),
+		uploadLimiter:    NewRateLimiter(current.UploadLimit),
+		announceKey:      newAnnounceKey(),
+		candidates:       make(map[string]*candidate),
+		poolWake:         make(chan struct{}, 1),
+		trackerCompleted: make(chan struct{}, 1),
 	}
-	return client
+	cl.pieceDone = sync.NewCond(&cl.mutex)
+	clients[torrent.ID] = cl
+	return cl
 }
 
 func (c *Client) AddPeer(peer *Peer) {
@@ -34,8 +78,182 @@ func (c *Client) AddPeer(peer *Peer) {
 	c.Peers = append(c.Peers, peer)
 }
 
-func GetClient() *Client {
-	clientMutex.Lock()
-	defer clientMutex.Unlock()
-	return client
+// Start announces to the tracker and connects to peers until Stop is called
+func (c *Client) Start(ctx context.Context) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cancel != nil {
+		return
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.lastUpload.Store(time.Now().Unix())
+	prev := c.trackerDone
+	c.trackerDone = make(chan struct{})
+	go c.runTracker(c.ctx, prev, c.trackerDone)
+	go c.runPool(c.ctx)
+	c.startWebSeeds(c.ctx)
+}
+
+// Stop disconnects from every peer
+func (c *Client) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	c.ctx = nil
+	c.cancel = nil
+	c.Peers = nil
+	// readers waiting for pieces give up
+	c.pieceDone.Broadcast()
+}
+
+// RemovePeer forgets a disconnected peer and the pieces it had
+func (c *Client) RemovePeer(peer *Peer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, p := range c.Peers {
+		if p == peer {
+			c.Peers = append(c.Peers[:i], c.Peers[i+1:]...)
+			break
+		}
+	}
+	c.picker.RemoveAvailability(peer.Bitfield)
+}
+
+// storePiece writes a piece that passed its hash check, from a peer or a
+// web seed, and marks it done. The piece goes back to the picker if it
+// can't be written.
+func (c *Client) storePiece(index int, data []byte) error {
+	err := c.storage.WritePiece(index, data)
+	if err != nil {
+		c.picker.Abort(index)
+		return err
+	}
+
+	c.mutex.Lock()
+	c.Bitfield.SetPiece(index)
+	c.pieceDone.Broadcast()
+	c.mutex.Unlock()
+	c.picker.Done(index)
+	publish(Event{Type: EventPieceCompleted, TorrentID: c.Torrent.ID, Data: PieceEvent{Index: index}})
+	if c.Torrent.status() == StatusDownloading && c.Complete() {
+		torrentCompleted(c)
+	}
+	return nil
+}
+
+func (c *Client) PeerCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.Peers)
+}
+
+// peerCounts returns the number of connected peers and how many of them are seeds
+func (c *Client) peerCounts() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	numPieces := c.Torrent.bencodeTorrent.NumPieces()
+	seeds := 0
+	for _, p := range c.Peers {
+		bitfield := p.snapshot().Bitfield
+		if bitfield != nil && countPieces(bitfield, numPieces) == numPieces {
+			seeds++
+		}
+	}
+	return len(c.Peers), seeds
+}
+
+// runContext returns the context of the running session, nil if stopped
+func (c *Client) runContext() context.Context {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ctx
+}
+
+func (c *Client) Active() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.cancel != nil
+}
+
+// Complete tells if every wanted piece has been downloaded
+func (c *Client) Complete() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.picker.Remaining(c.Bitfield) == 0
+}
+
+// Left is how many bytes of wanted pieces we still need
+func (c *Client) Left() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var left int64
+	for i := 0; i < c.Torrent.bencodeTorrent.NumPieces(); i++ {
+		if c.Bitfield.HasPiece(i) || c.Torrent.piecePriority(i) == PrioritySkip {
+			continue
+		}
+		start, end := c.Torrent.pieceSpan(i)
+		left += end - start
+	}
+	return left
+}
+
+// completed is how many bytes of verified pieces fall inside [start, end)
+// of the torrent
+func (c *Client) completed(start, end int64) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pieceLength := int64(c.Torrent.bencodeTorrent.Info.PieceLength)
+	var done int64
+	for i := int(start / pieceLength); i < c.Torrent.bencodeTorrent.NumPieces(); i++ {
+		pieceStart, pieceEnd := c.Torrent.pieceSpan(i)
+		if pieceStart >= end {
+			break
+		}
+		if c.Bitfield.HasPiece(i) {
+			done += min(pieceEnd, end) - max(pieceStart, start)
+		}
+	}
+	return done
+}
+
+// Completed is how many bytes of the torrent we have
+func (c *Client) Completed() int64 {
+	return c.completed(0, c.Torrent.TotalLength)
+}
+
+// FileCompleted is how many bytes of a file we have
+func (c *Client) FileCompleted(fileIndex int) int64 {
+	f := c.Torrent.files()[fileIndex]
+	return c.completed(f.offset, f.offset+f.length)
+}
+
+// GetClient returns the client of a torrent by its database id
+func GetClient(torrentID int) *Client {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	return clients[torrentID]
+}
+
+func removeClient(torrentID int) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	delete(clients, torrentID)
+}
+
+// clientFor returns the client downloading the given torrent, if any
+func clientFor(t *Torrent) *Client {
+	cl := GetClient(t.ID)
+	if cl == nil || cl.Torrent != t {
+		return nil
+	}
+	return cl
 }
@@ -0,0 +1,217 @@
+package backend
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// handshakeTimeout bounds the encryption and BitTorrent handshakes
+	handshakeTimeout = 10 * time.Second
+	// inactivityTimeout drops peers that sent nothing, not even a keep-alive
+	inactivityTimeout = 2 * time.Minute
+	// keepAliveInterval is how long we stay quiet before sending a keep-alive
+	keepAliveInterval = 90 * time.Second
+	// maxMessageLength caps what a peer can make us allocate. The largest
+	// legitimate messages are blocks and the bitfields of huge torrents.
+	maxMessageLength = 1 << 20
+)
+
+// maxQueuedBytes caps the outbound queue of a connection. Requests for
+// blocks beyond it are refused until the writer catches up.
+const maxQueuedBytes = 4 << 20
+
+// peerConn carries the messages of a peer connection once the handshakes
+// are done. A reader goroutine hands what arrives to the connection's loop
+// and a writer goroutine sends what the loop queues, so the loop, which
+// owns the peer's state, never waits on the network. Reads time out after
+// inactivityTimeout, and the writer sends a keep-alive when it's been
+// quiet for keepAliveInterval.
+type peerConn struct {
+	net.Conn
+	// incoming carries the messages read, keep-alives left out
+	incoming chan *Message
+	// mutex guards the outbound queue
+	mutex  sync.Mutex
+	queue  [][]byte
+	queued int
+	// wake tells the writer there's something in the queue
+	wake chan struct{}
+	// err is why the connection ended, set before done is closed
+	err       error
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newPeerConn(conn net.Conn) *peerConn {
+	c := &peerConn{
+		Conn:     conn,
+		incoming: make(chan *Message),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.writeLoop()
+	return c
+}
+
+func (c *peerConn) readLoop() {
+	for {
+		err := c.Conn.SetReadDeadline(time.Now().Add(inactivityTimeout))
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		msg, err := Read(c.Conn)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if msg == nil {
+			// keep-alive, the read deadline moves on with the next read
+			continue
+		}
+
+		select {
+		case c.incoming <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Write queues a whole message for the writer and returns right away. It
+// fails once the connection has ended.
+func (c *peerConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, c.err
+	default:
+	}
+
+	c.mutex.Lock()
+	c.queue = append(c.queue, p)
+	c.queued += len(p)
+	c.mutex.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Queued is how many bytes wait in the outbound queue
+func (c *peerConn) Queued() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.queued
+}
+
+func (c *peerConn) writeLoop() {
+	ticker := time.NewTicker(keepAliveInterval / 3)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		case <-ticker.C:
+			if time.Since(lastWrite) >= keepAliveInterval {
+				var keepAlive *Message
+				c.Write(keepAlive.Serialize())
+			}
+			continue
+		}
+
+		for {
+			c.mutex.Lock()
+			if len(c.queue) == 0 {
+				c.mutex.Unlock()
+				break
+			}
+			p := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.mutex.Unlock()
+
+			// a peer that doesn't take a message within inactivityTimeout is gone
+			err := c.Conn.SetWriteDeadline(time.Now().Add(inactivityTimeout))
+			if err == nil {
+				_, err = c.Conn.Write(p)
+			}
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			lastWrite = time.Now()
+
+			c.mutex.Lock()
+			c.queued -= len(p)
+			c.mutex.Unlock()
+		}
+	}
+}
+
+// fail ends the connection the first time it's called, recording why
+func (c *peerConn) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.Conn.Close()
+	})
+}
+
+// Err is why the connection ended, once Done is closed
+func (c *peerConn) Err() error {
+	return c.err
+}
+
+// Done is closed when the connection ends
+func (c *peerConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close can be called more than once, closing the connection the first time
+func (c *peerConn) Close() error {
+	c.fail(net.ErrClosed)
+	return nil
+}
+
+// validMessage checks the payload length of the messages we handle and
+// the piece indexes in them, so handlers can trust both. Fast Extension
+// messages are invalid unless both sides set the extension bit.
+func validMessage(msg *Message, numPieces int, fast bool) bool {
+	index := func() bool {
+		return int64(binary.BigEndian.Uint32(msg.Payload[0:4])) < int64(numPieces)
+	}
+
+	switch msg.ID {
+	case MsgHaveAll, MsgHaveNone, MsgSuggest, MsgReject, MsgAllowedFast:
+		if !fast {
+			return false
+		}
+	}
+
+	switch msg.ID {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		return len(msg.Payload) == 0
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		return len(msg.Payload) == 4 && index()
+	case MsgRequest, MsgCancel, MsgReject:
+		return len(msg.Payload) == 12 && index()
+	case MsgBitfield:
+		return len(msg.Payload) == (numPieces+7)/8
+	case MsgPiece:
+		return len(msg.Payload) >= 8 && len(msg.Payload) <= 8+BlockSize && index()
+	case MsgExtended:
+		return len(msg.Payload) >= 1
+	default:
+		// unknown messages are ignored
+		return true
+	}
+}
@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	minPieceLength = 256 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// targetPieces is roughly how many pieces an automatic piece length aims for
+	targetPieces = 1500
+)
+
+// CreateTorrent builds the metainfo of a file or directory. A zero piece
+// length picks one from the total size. Private torrents get the BEP 27
+// flag, so clients only use the tracker to find peers.
+func CreateTorrent(path, announce string, pieceLength int, private bool) ([]byte, error) {
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	if info.IsDir() {
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s has no files", path)
+		}
+	} else {
+		files = []string{root}
+	}
+
+	var total int64
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		total += fi.Size()
+	}
+
+	if pieceLength == 0 {
+		pieceLength = pickPieceLength(total)
+	}
+	if pieceLength < BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length must be a power of two of at least %d", BlockSize)
+	}
+
+	pieces, err := hashFiles(files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	infoDict := map[string]interface{}{
+		"name":         info.Name(),
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	}
+	if private {
+		infoDict["private"] = 1
+	}
+	if info.IsDir() {
+		list := make([]map[string]interface{}, 0, len(files))
+		for _, f := range files {
+			fi, err := os.Stat(f)
+			if err != nil {
+				return nil, err
+			}
+			rel, err := filepath.Rel(root, f)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, map[string]interface{}{
+				"length": fi.Size(),
+				"path":   strings.Split(filepath.ToSlash(rel), "/"),
+			})
+		}
+		infoDict["files"] = list
+	} else {
+		infoDict["length"] = total
+	}
+
+	metainfo := map[string]interface{}{
+		"info":          infoDict,
+		"created by":    "gorrent",
+		"creation date": time.Now().Unix(),
+	}
+	if announce != "" {
+		metainfo["announce"] = announce
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, metainfo)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pickPieceLength returns the smallest power of two that keeps the piece
+// count around targetPieces
+func pickPieceLength(total int64) int {
+	length := minPieceLength
+	for length < maxPieceLength && total/int64(length) > targetPieces {
+		length *= 2
+	}
+	return length
+}
+
+// hashFiles returns the concatenated piece hashes of the files read back to back
+func hashFiles(files []string, pieceLength int) (string, error) {
+	readers := make([]io.Reader, 0, len(files))
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	r := io.MultiReader(readers...)
+	var pieces bytes.Buffer
+	buf := make([]byte, pieceLength)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h := sha1.Sum(buf[:n])
+			pieces.Write(h[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return pieces.String(), nil
+}
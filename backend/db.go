@@ -2,16 +2,22 @@ package backend
 
 import (
 	"database/sql"
+	"encoding/binary"
+	"encoding/json"
 	"log"
+	"sync/atomic"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var db *sql.DB
 
+// DatabasePath is the SQLite file InitDB opens
+var DatabasePath = "./gorrent.db"
+
 func InitDB() {
 	var err error
-	db, err = sql.Open("sqlite3", "./gorrent.db")
+	db, err = sql.Open("sqlite3", DatabasePath)
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
@@ -35,18 +41,76 @@ func createTable() {
 	if err != nil {
 		log.Fatalf("Error executing table creation statement: %v", err)
 	}
+
+	createPrioritiesSQL := `CREATE TABLE IF NOT EXISTS file_priorities (
+        "torrent_id" INTEGER NOT NULL,
+        "file_index" INTEGER NOT NULL,
+        "priority" INTEGER NOT NULL,
+        PRIMARY KEY (torrent_id, file_index)
+    );`
+
+	_, err = db.Exec(createPrioritiesSQL)
+	if err != nil {
+		log.Fatalf("Error executing file priorities table creation statement: %v", err)
+	}
+
+	addColumn("torrents", "queue_position", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("torrents", "uploaded", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("torrents", "downloaded", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("torrents", "seeding_time", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("torrents", "seeding_goals", "TEXT")
+	addColumn("torrents", "metainfo", "BLOB")
+	addColumn("torrents", "bitfield", "BLOB")
+	addColumn("torrents", "parts_index", "BLOB")
+}
+
+// addColumn adds a column to a table created by an older version
+func addColumn(table, column, definition string) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		log.Fatalf("Error reading %s columns: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			log.Fatalf("Error reading %s columns: %v", table, err)
+		}
+		if name == column {
+			return
+		}
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil {
+		log.Fatalf("Error adding column %s to %s: %v", column, table, err)
+	}
 }
 
 func Insert(t *Torrent) {
-	insertSQL := `INSERT INTO torrents (name, size, status) VALUES (?, ?, ?)`
+	insertSQL := `INSERT INTO torrents (name, size, status, metainfo, queue_position)
+        VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(queue_position), 0) + 1 FROM torrents))`
 	statement, err := db.Prepare(insertSQL)
 	if err != nil {
 		log.Fatalf("Error preparing insert statement: %v", err)
 	}
-	_, err = statement.Exec(t.TorrentName, t.TotalLength, t.Status)
+	res, err := statement.Exec(t.TorrentName, t.TotalLength, t.Status, t.metainfo)
 	if err != nil {
 		log.Fatalf("Error executing insert statement: %v", err)
 	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Fatalf("Error reading inserted torrent id: %v", err)
+	}
+	t.ID = int(id)
+
+	err = db.QueryRow("SELECT queue_position FROM torrents WHERE id = ?", t.ID).Scan(&t.QueuePosition)
+	if err != nil {
+		log.Fatalf("Error reading queue position: %v", err)
+	}
 }
 
 func Remove(id int) {
@@ -59,23 +123,179 @@ func Remove(id int) {
 	if err != nil {
 		log.Fatalf("Error executing delete statement: %v", err)
 	}
+
+	_, err = db.Exec(`DELETE FROM file_priorities WHERE torrent_id = ?`, id)
+	if err != nil {
+		log.Fatalf("Error deleting file priorities: %v", err)
+	}
 }
 
-func GetTorrents() ([]Torrent, error) {
-	rows, err := db.Query("SELECT id, name, size, status FROM torrents")
+func GetTorrents() ([]*Torrent, error) {
+	rows, err := db.Query(`SELECT id, name, size, status, queue_position, uploaded, downloaded, seeding_time, seeding_goals
+        FROM torrents ORDER BY queue_position`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var torrents []Torrent
+	var torrents []*Torrent
 	for rows.Next() {
-		var torrent Torrent
-		err = rows.Scan(&torrent.ID, &torrent.TorrentName, &torrent.TotalLength, &torrent.Status)
+		torrent := &Torrent{}
+		var goals sql.NullString
+		err = rows.Scan(&torrent.ID, &torrent.TorrentName, &torrent.TotalLength, &torrent.Status, &torrent.QueuePosition,
+			&torrent.Uploaded, &torrent.Downloaded, &torrent.SeedingTime, &goals)
 		if err != nil {
 			return nil, err
 		}
+
+		if goals.Valid {
+			err = json.Unmarshal([]byte(goals.String), &torrent.SeedingGoals)
+			if err != nil {
+				return nil, err
+			}
+		}
+		torrent.Ratio = torrent.ShareRatio()
+
+		// torrents loaded in this session have live state
+		if loaded := GetTorrent(torrent.ID); loaded != nil {
+			torrent = loaded.Snapshot()
+		}
 		torrents = append(torrents, torrent)
 	}
 	return torrents, nil
 }
+
+func updateStatus(id int, status string) error {
+	_, err := db.Exec("UPDATE torrents SET status = ? WHERE id = ?", status, id)
+	return err
+}
+
+func updateQueuePosition(id, position int) error {
+	_, err := db.Exec("UPDATE torrents SET queue_position = ? WHERE id = ?", position, id)
+	return err
+}
+
+// saveResumeData stores what's needed to pick a torrent up where it left off
+func saveResumeData(cl *Client) error {
+	cl.mutex.Lock()
+	bitfield := append([]byte(nil), cl.Bitfield...)
+	cl.mutex.Unlock()
+
+	_, err := db.Exec("UPDATE torrents SET bitfield = ?, parts_index = ? WHERE id = ?",
+		bitfield, encodePartsIndex(cl.storage.partsIndex()), cl.Torrent.ID)
+	if err != nil {
+		return err
+	}
+	return saveTransferStats(cl.Torrent)
+}
+
+type resumeRow struct {
+	torrent  Torrent
+	metainfo []byte
+	bitfield []byte
+	parts    []int
+}
+
+// getResumeRows returns the torrents saved with their metainfo
+func getResumeRows() ([]*resumeRow, error) {
+	rows, err := db.Query(`SELECT id, status, queue_position, uploaded, downloaded, seeding_time, seeding_goals, metainfo, bitfield, parts_index
+        FROM torrents WHERE metainfo IS NOT NULL ORDER BY queue_position`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var resume []*resumeRow
+	for rows.Next() {
+		r := &resumeRow{}
+		var status, goals sql.NullString
+		var parts []byte
+		err = rows.Scan(&r.torrent.ID, &status, &r.torrent.QueuePosition, &r.torrent.Uploaded, &r.torrent.Downloaded,
+			&r.torrent.SeedingTime, &goals, &r.metainfo, &r.bitfield, &parts)
+		if err != nil {
+			return nil, err
+		}
+		r.parts = decodePartsIndex(parts)
+
+		r.torrent.Status = status.String
+		if goals.Valid {
+			err = json.Unmarshal([]byte(goals.String), &r.torrent.SeedingGoals)
+			if err != nil {
+				return nil, err
+			}
+		}
+		resume = append(resume, r)
+	}
+	return resume, nil
+}
+
+func saveTransferStats(t *Torrent) error {
+	_, err := db.Exec("UPDATE torrents SET uploaded = ?, downloaded = ?, seeding_time = ? WHERE id = ?",
+		atomic.LoadInt64(&t.Uploaded), atomic.LoadInt64(&t.Downloaded), atomic.LoadInt64(&t.SeedingTime), t.ID)
+	return err
+}
+
+// saveSeedingGoals stores the goals of a torrent, nil meaning the global ones apply
+func saveSeedingGoals(id int, goals *SeedingGoals) error {
+	var value sql.NullString
+	if goals != nil {
+		b, err := json.Marshal(goals)
+		if err != nil {
+			return err
+		}
+		value = sql.NullString{String: string(b), Valid: true}
+	}
+
+	_, err := db.Exec("UPDATE torrents SET seeding_goals = ? WHERE id = ?", value, id)
+	return err
+}
+
+func saveFilePriority(torrentID, fileIndex int, priority FilePriority) error {
+	upsertSQL := `INSERT INTO file_priorities (torrent_id, file_index, priority) VALUES (?, ?, ?)
+        ON CONFLICT (torrent_id, file_index) DO UPDATE SET priority = excluded.priority`
+	_, err := db.Exec(upsertSQL, torrentID, fileIndex, priority)
+	return err
+}
+
+func getFilePriorities(torrentID int) (map[int]FilePriority, error) {
+	rows, err := db.Query("SELECT file_index, priority FROM file_priorities WHERE torrent_id = ?", torrentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	priorities := make(map[int]FilePriority)
+	for rows.Next() {
+		var index int
+		var priority FilePriority
+		err = rows.Scan(&index, &priority)
+		if err != nil {
+			return nil, err
+		}
+		priorities[index] = priority
+	}
+	return priorities, nil
+}
+
+// encodePartsIndex stores the piece of each parts file slot as a 4 byte
+// big-endian number, 0xffffffff for a free slot
+func encodePartsIndex(slots []int) []byte {
+	buf := make([]byte, 4*len(slots))
+	for i, index := range slots {
+		binary.BigEndian.PutUint32(buf[4*i:], uint32(index))
+	}
+	return buf
+}
+
+func decodePartsIndex(buf []byte) []int {
+	slots := make([]int, len(buf)/4)
+	for i := range slots {
+		index := binary.BigEndian.Uint32(buf[4*i:])
+		if index == 0xffffffff {
+			slots[i] = -1
+		} else {
+			slots[i] = int(index)
+		}
+	}
+	return slots
+}
@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"sync"
+)
+
+type EventType string
+
+const (
+	EventPeerConnected    EventType = "peer-connect"
+	EventPeerDisconnected EventType = "peer-disconnect"
+	EventPieceCompleted   EventType = "piece-completed"
+	EventTorrentState     EventType = "torrent-state"
+	EventTrackerError     EventType = "tracker-error"
+	EventStatsTick        EventType = "stats"
+)
+
+// Event is something that happened to a torrent. Data holds the payload
+// matching the type: PeerEvent, PieceEvent, StateEvent, TrackerErrorEvent
+// or StatsEvent.
+type Event struct {
+	Type      EventType   `json:"type"`
+	TorrentID int         `json:"torrentId"`
+	Data      interface{} `json:"data"`
+}
+
+type PeerEvent struct {
+	Address string `json:"address"`
+}
+
+type PieceEvent struct {
+	Index int `json:"index"`
+}
+
+type StateEvent struct {
+	Status string `json:"status"`
+}
+
+type TrackerErrorEvent struct {
+	Announce string `json:"announce"`
+	Error    string `json:"error"`
+}
+
+// StatsEvent holds the TorrentStats fields that changed since the last
+// tick, keyed by their JSON name
+type StatsEvent map[string]interface{}
+
+// Publisher receives the events it subscribed to. Publish is called from
+// the engine's goroutines and must not block.
+type Publisher interface {
+	Publish(e Event)
+}
+
+// EventFilter selects the events a subscriber gets, nil meaning all of them
+type EventFilter func(e Event) bool
+
+// FilterTypes passes events of the given types
+func FilterTypes(types ...EventType) EventFilter {
+	return func(e Event) bool {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FilterTorrent passes events of a single torrent
+func FilterTorrent(torrentID int) EventFilter {
+	return func(e Event) bool {
+		return e.TorrentID == torrentID
+	}
+}
+
+type subscription struct {
+	publisher Publisher
+	filter    EventFilter
+}
+
+var (
+	subscriptions      = make(map[int]subscription)
+	nextSubscriptionID int
+	subscriptionsMutex sync.Mutex
+)
+
+// Subscribe sends the events passing filter to p until the returned
+// function is called
+func Subscribe(p Publisher, filter EventFilter) func() {
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+
+	id := nextSubscriptionID
+	nextSubscriptionID++
+	subscriptions[id] = subscription{publisher: p, filter: filter}
+
+	return func() {
+		subscriptionsMutex.Lock()
+		defer subscriptionsMutex.Unlock()
+		delete(subscriptions, id)
+	}
+}
+
+// publish hands an event to every matching subscriber
+func publish(e Event) {
+	subscriptionsMutex.Lock()
+	matching := make([]Publisher, 0, len(subscriptions))
+	for _, s := range subscriptions {
+		if s.filter == nil || s.filter(e) {
+			matching = append(matching, s.publisher)
+		}
+	}
+	subscriptionsMutex.Unlock()
+
+	for _, p := range matching {
+		p.Publish(e)
+	}
+}
+
+// ChannelPublisher buffers events in a channel, for daemons and tests.
+// Events are dropped while the buffer is full rather than stalling peers.
+type ChannelPublisher struct {
+	C chan Event
+}
+
+func NewChannelPublisher(size int) *ChannelPublisher {
+	return &ChannelPublisher{C: make(chan Event, size)}
+}
+
+func (p *ChannelPublisher) Publish(e Event) {
+	select {
+	case p.C <- e:
+	default:
+	}
+}
@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// drainEvents returns the events buffered in p
+func drainEvents(p *ChannelPublisher) []Event {
+	var events []Event
+	for {
+		select {
+		case e := <-p.C:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	typed := NewChannelPublisher(16)
+	unsubscribeTyped := Subscribe(typed, FilterTypes(EventTorrentState, EventTrackerError))
+	defer unsubscribeTyped()
+
+	single := NewChannelPublisher(16)
+	unsubscribeSingle := Subscribe(single, FilterTorrent(2))
+
+	all := NewChannelPublisher(16)
+	unsubscribeAll := Subscribe(all, nil)
+	defer unsubscribeAll()
+
+	events := []Event{
+		{Type: EventTorrentState, TorrentID: 1, Data: StateEvent{Status: StatusDownloading}},
+		{Type: EventPieceCompleted, TorrentID: 2, Data: PieceEvent{Index: 3}},
+		{Type: EventTrackerError, TorrentID: 2, Data: TrackerErrorEvent{Announce: "http://tracker", Error: "timeout"}},
+		{Type: EventPeerConnected, TorrentID: 1, Data: PeerEvent{Address: "127.0.0.1:6881"}},
+	}
+	for _, e := range events {
+		publish(e)
+	}
+
+	got := drainEvents(typed)
+	if len(got) != 2 || got[0].Type != EventTorrentState || got[1].Type != EventTrackerError {
+		t.Errorf("type filter delivered %v", got)
+	}
+	got = drainEvents(single)
+	if len(got) != 2 || got[0].Type != EventPieceCompleted || got[1].Type != EventTrackerError {
+		t.Errorf("torrent filter delivered %v", got)
+	}
+	if got := drainEvents(all); len(got) != len(events) {
+		t.Errorf("nil filter delivered %d events, want %d", len(got), len(events))
+	}
+
+	// nothing arrives after unsubscribing
+	unsubscribeSingle()
+	publish(Event{Type: EventPieceCompleted, TorrentID: 2, Data: PieceEvent{Index: 4}})
+	if got := drainEvents(single); len(got) != 0 {
+		t.Errorf("unsubscribed publisher got %v", got)
+	}
+
+	// a full buffer drops events rather than blocking
+	full := NewChannelPublisher(1)
+	unsubscribeFull := Subscribe(full, nil)
+	defer unsubscribeFull()
+	publish(Event{Type: EventStatsTick, TorrentID: 1})
+	publish(Event{Type: EventStatsTick, TorrentID: 2})
+	if got := drainEvents(full); len(got) != 1 || got[0].TorrentID != 1 {
+		t.Errorf("full publisher got %v", got)
+	}
+}
+
+func TestPieceCompletedEvents(t *testing.T) {
+	newTestSession(t)
+
+	src := filepath.Join(t.TempDir(), "events.bin")
+	writeTestFile(t, src, 70000)
+	torrent := addTestTorrent(t, src, 16<<10)
+	numPieces := torrent.bencodeTorrent.NumPieces()
+
+	events := NewChannelPublisher(64)
+	unsubscribe := Subscribe(events, func(e Event) bool {
+		return e.TorrentID == torrent.ID && e.Type == EventPieceCompleted
+	})
+	defer unsubscribe()
+	// events of other torrents don't pass the filter
+	publish(Event{Type: EventPieceCompleted, TorrentID: torrent.ID + 1, Data: PieceEvent{Index: 0}})
+
+	server := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir(src))))
+	defer server.Close()
+
+	cl := NewClient(torrent)
+	runTestWebSeed(t, cl, server.URL+"/events.bin")
+
+	seen := make(map[int]bool)
+	timeout := time.After(10 * time.Second)
+	for len(seen) < numPieces {
+		select {
+		case e := <-events.C:
+			piece, ok := e.Data.(PieceEvent)
+			if !ok || e.TorrentID != torrent.ID || seen[piece.Index] {
+				t.Fatalf("unexpected event %+v", e)
+			}
+			seen[piece.Index] = true
+		case <-timeout:
+			t.Fatalf("got piece-completed for %d pieces, want %d", len(seen), numPieces)
+		}
+	}
+	if !cl.Complete() {
+		t.Error("every piece was reported but the download isn't complete")
+	}
+	if got := drainEvents(events); len(got) != 0 {
+		t.Errorf("unexpected events %v", got)
+	}
+}
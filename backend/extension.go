@@ -0,0 +1,127 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Extension Protocol (BEP 10) message, carrying the extension handshake and
+// the metadata exchange (BEP 9)
+const MsgExtended messageID = 20
+
+const (
+	// extensionBit is set in the sixth reserved handshake byte by clients
+	// supporting BEP 10
+	extensionBit = 0x10
+	// extHandshakeID is the extended message id of the extension handshake
+	extHandshakeID = 0
+	// utMetadataID is the extended message id peers send us ut_metadata
+	// messages with
+	utMetadataID = 1
+	// metadataPieceSize is the size of the pieces the info dictionary is
+	// exchanged in
+	metadataPieceSize = 16384
+	// maxMetadataSize caps the info dictionary a peer can make us download
+	maxMetadataSize = 8 << 20
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// extHandshake is the extension handshake. M maps the extensions a peer
+// supports to the extended message ids it wants them sent with.
+type extHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// metadataMessage is the header of a ut_metadata message. Data messages
+// carry the piece right after it.
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// sendExtended sends the extended message id, a bencoded msg followed by data
+func sendExtended(conn net.Conn, peer *Peer, id int, msg interface{}, data []byte) error {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(id))
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return peer.SendMessage(conn, MsgExtended, buf.Bytes())
+}
+
+// parseMetadataMessage splits a ut_metadata message into its header and data
+func parseMetadataMessage(payload []byte) (*metadataMessage, []byte, error) {
+	end, err := bencodeEnd(payload, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var msg metadataMessage
+	err = bencode.Unmarshal(bytes.NewReader(payload[:end]), &msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &msg, payload[end:], nil
+}
+
+// sendExtHandshake tells a peer supporting BEP 10 that we serve the
+// metadata of the torrent, unless it's private
+func sendExtHandshake(conn net.Conn, cl *Client, peer *Peer) error {
+	hs := extHandshake{M: map[string]int{}}
+	if !cl.Torrent.Private {
+		hs.M["ut_metadata"] = utMetadataID
+		hs.MetadataSize = len(cl.Torrent.bencodeTorrent.Info.raw)
+	}
+	return sendExtended(conn, peer, extHandshakeID, hs, nil)
+}
+
+// handleExtended handles the extension handshake of a peer and its
+// requests for the metadata
+func handleExtended(conn *peerConn, cl *Client, payload []byte, peer *Peer) {
+	switch payload[0] {
+	case extHandshakeID:
+		var hs extHandshake
+		err := bencode.Unmarshal(bytes.NewReader(payload[1:]), &hs)
+		if err != nil {
+			fmt.Printf("Invalid extension handshake from %s: %v\n", peer.String(), err)
+			return
+		}
+		peer.utMetadata = hs.M["ut_metadata"]
+	case utMetadataID:
+		msg, _, err := parseMetadataMessage(payload[1:])
+		if err != nil || msg.MsgType != metadataRequest || peer.utMetadata == 0 {
+			return
+		}
+
+		err = serveMetadata(conn, cl, peer, msg.Piece)
+		if err != nil {
+			fmt.Println("Error sending metadata", err)
+		}
+	}
+}
+
+// serveMetadata answers a request for a piece of the info dictionary
+func serveMetadata(conn net.Conn, cl *Client, peer *Peer, piece int) error {
+	info := cl.Torrent.bencodeTorrent.Info.raw
+	start := piece * metadataPieceSize
+	if cl.Torrent.Private || piece < 0 || start >= len(info) {
+		return sendExtended(conn, peer, peer.utMetadata, metadataMessage{MsgType: metadataReject, Piece: piece}, nil)
+	}
+
+	end := min(start+metadataPieceSize, len(info))
+	msg := metadataMessage{MsgType: metadataData, Piece: piece, TotalSize: len(info)}
+	return sendExtended(conn, peer, peer.utMetadata, msg, info[start:end])
+}
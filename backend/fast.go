@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// Fast Extension (BEP 6) messages
+const (
+	MsgSuggest     messageID = 13
+	MsgHaveAll     messageID = 14
+	MsgHaveNone    messageID = 15
+	MsgReject      messageID = 16
+	MsgAllowedFast messageID = 17
+)
+
+const (
+	// fastExtensionBit is set in the last reserved handshake byte by
+	// clients supporting BEP 6
+	fastExtensionBit = 0x04
+	// allowedFastCount is how many pieces a choked peer may request from us
+	allowedFastCount = 10
+	// maxSuggestions caps the suggested pieces remembered per peer
+	maxSuggestions = 16
+)
+
+// sendHaves tells a new peer which pieces we have, with HAVE_ALL or
+// HAVE_NONE instead of a bitfield when the peer supports them
+func sendHaves(conn net.Conn, cl *Client, peer *Peer) error {
+	cl.mutex.Lock()
+	have := append(Bitfield(nil), cl.Bitfield...)
+	cl.mutex.Unlock()
+
+	numPieces := cl.Torrent.bencodeTorrent.NumPieces()
+	switch {
+	case peer.fast && countPieces(have, numPieces) == numPieces:
+		return peer.SendMessage(conn, MsgHaveAll, nil)
+	case peer.fast && !have.Any():
+		return peer.SendMessage(conn, MsgHaveNone, nil)
+	case have.Any():
+		return peer.SendMessage(conn, MsgBitfield, have)
+	}
+	return nil
+}
+
+// sendAllowedFast lets a fast peer download a few pieces even while we
+// choke it, so new peers have something to trade
+func sendAllowedFast(conn net.Conn, cl *Client, peer *Peer) error {
+	ip := net.ParseIP(peer.IP).To4()
+	if ip == nil {
+		// BEP 6 only defines the set for IPv4
+		return nil
+	}
+
+	bt := cl.Torrent.bencodeTorrent
+	set := allowedFastSet(ip, bt.Info.hash(), bt.NumPieces(), allowedFastCount)
+	peer.allowedFastOut = make(map[int]bool, len(set))
+	for _, index := range set {
+		peer.allowedFastOut[index] = true
+
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(index))
+		err := peer.SendMessage(conn, MsgAllowedFast, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowedFastSet computes the canonical allowed fast pieces of an IPv4 peer
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	k = min(k, numPieces)
+	set := make([]int, 0, k)
+
+	// the last octet is dropped so peers behind one /24 share a set
+	x := make([]byte, 0, 24)
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash[:]...)
+
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !containsPiece(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+func containsPiece(pieces []int, index int) bool {
+	for _, p := range pieces {
+		if p == index {
+			return true
+		}
+	}
+	return false
+}
+
+// fullBitfield is the bitfield of a peer that sent HAVE_ALL
+func fullBitfield(numPieces int) Bitfield {
+	bf := NewBitfield(make([]byte, (numPieces+7)/8))
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+// rejectRequest tells a fast peer we won't serve its request. Other peers
+// just never get an answer.
+func rejectRequest(conn net.Conn, peer *Peer, index int, begin, length int64) error {
+	if !peer.fast {
+		return nil
+	}
+
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return peer.SendMessage(conn, MsgReject, payload)
+}
+
+// pickPiece chooses the next piece to download from a peer: an allowed fast
+// one while choked, otherwise one it suggested or the picker's choice.
+// Pieces that failed their hash check from this peer are left to other
+// peers that have them, and pieces it rejected aren't asked for again.
+// cl.mutex must be held.
+func pickPiece(cl *Client, peer *Peer) (int, bool) {
+	bitfield := peer.Bitfield
+	if len(peer.failed) > 0 || len(peer.rejected) > 0 {
+		bitfield = make(Bitfield, len(peer.Bitfield))
+		copy(bitfield, peer.Bitfield)
+		for index := range peer.failed {
+			if index/8 < len(bitfield) && cl.picker.PieceAvailability(index) > 1 {
+				bitfield[index/8] &^= 1 << (7 - index%8)
+			}
+		}
+		for index := range peer.rejected {
+			if index/8 < len(bitfield) {
+				bitfield[index/8] &^= 1 << (7 - index%8)
+			}
+		}
+	}
+	return pickPieceFrom(cl, peer, bitfield)
+}
+
+// pickPieceFrom is pickPiece among the pieces set in bitfield
+func pickPieceFrom(cl *Client, peer *Peer, bitfield Bitfield) (int, bool) {
+	if peer.ClientChoked {
+		allowed := make([]int, 0, len(peer.allowedFast))
+		for index := range peer.allowedFast {
+			allowed = append(allowed, index)
+		}
+		return cl.picker.PickFrom(allowed, bitfield, cl.Bitfield)
+	}
+
+	if len(peer.suggested) > 0 {
+		index, ok := cl.picker.PickFrom(peer.suggested, bitfield, cl.Bitfield)
+		if ok {
+			return index, true
+		}
+		peer.suggested = nil
+	}
+	return cl.picker.Pick(bitfield, cl.Bitfield)
+}
@@ -0,0 +1,195 @@
+package backend
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// FilePriority tells the piece picker how much we want a file
+type FilePriority int
+
+const (
+	PrioritySkip   FilePriority = 0
+	PriorityLow    FilePriority = 1
+	PriorityNormal FilePriority = 2
+	PriorityHigh   FilePriority = 3
+)
+
+type torrentFile struct {
+	path   string
+	length int64
+	// offset of the first byte of the file inside the torrent's byte stream
+	offset int64
+}
+
+// files lays out the torrent's files one after the other, the way pieces see them
+func (t *Torrent) files() []torrentFile {
+	info := t.bencodeTorrent.Info
+	if !t.IsMultiFile {
+		return []torrentFile{{path: info.Name, length: int64(info.Length)}}
+	}
+
+	var files []torrentFile
+	var offset int64
+	for _, f := range info.Files {
+		files = append(files, torrentFile{
+			path:   filepath.Join(append([]string{info.Name}, f.Path...)...),
+			length: int64(f.Length),
+			offset: offset,
+		})
+		offset += int64(f.Length)
+	}
+	return files
+}
+
+// checkPaths rejects torrents whose name or file paths would lead out of
+// the download directory, since files() joins them as they are
+func (bI *bencodeInfo) checkPaths() error {
+	err := checkPathElement(bI.Name)
+	if err != nil {
+		return fmt.Errorf("invalid torrent name: %w", err)
+	}
+
+	for _, f := range bI.Files {
+		if len(f.Path) == 0 {
+			return fmt.Errorf("invalid file path: empty")
+		}
+		for _, element := range f.Path {
+			err := checkPathElement(element)
+			if err != nil {
+				return fmt.Errorf("invalid file path %q: %w", strings.Join(f.Path, "/"), err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkPathElement accepts a single, non-empty, local path element
+func checkPathElement(element string) error {
+	if element == "" || element == "." {
+		return fmt.Errorf("empty element")
+	}
+	if strings.ContainsAny(element, `/\`) {
+		return fmt.Errorf("%q holds a path separator", element)
+	}
+	if !filepath.IsLocal(element) {
+		return fmt.Errorf("%q isn't a local name", element)
+	}
+	return nil
+}
+
+// pieceSpan returns the [start, end) byte range covered by a piece
+func (t *Torrent) pieceSpan(index int) (int64, int64) {
+	pieceLength := int64(t.bencodeTorrent.Info.PieceLength)
+	start := int64(index) * pieceLength
+	end := start + pieceLength
+	if end > t.TotalLength {
+		end = t.TotalLength
+	}
+	return start, end
+}
+
+// piecePriority is the highest priority among the files a piece overlaps,
+// so boundary pieces are still fetched when only one side is wanted
+func (t *Torrent) piecePriority(index int) FilePriority {
+	start, end := t.pieceSpan(index)
+	priority := PrioritySkip
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, f := range t.files() {
+		if f.offset < end && f.offset+f.length > start && t.FilePriorities[i] > priority {
+			priority = t.FilePriorities[i]
+		}
+	}
+	return priority
+}
+
+// loadFilePriorities applies the priorities stored for a torrent on top of the defaults
+func loadFilePriorities(t *Torrent) error {
+	priorities, err := getFilePriorities(t.ID)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, priority := range priorities {
+		if i < len(t.FilePriorities) {
+			t.FilePriorities[i] = priority
+		}
+	}
+	return nil
+}
+
+func SetFilePriority(torrentID, fileIndex int, priority FilePriority) error {
+	t := GetTorrent(torrentID)
+	if t == nil {
+		return fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	if fileIndex < 0 || fileIndex >= len(t.FilePriorities) {
+		return fmt.Errorf("invalid file index %d", fileIndex)
+	}
+
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+
+	t.mutex.Lock()
+	t.FilePriorities[fileIndex] = priority
+	t.mutex.Unlock()
+
+	err := saveFilePriority(torrentID, fileIndex, priority)
+	if err != nil {
+		return err
+	}
+
+	cl := clientFor(t)
+	if cl == nil {
+		return nil
+	}
+
+	cl.picker.UpdatePriorities(t)
+	err = cl.storage.ApplyPriorities()
+	if err != nil {
+		return err
+	}
+
+	// a seeding torrent may have something to download again
+	updateQueue()
+	return nil
+}
+
+// SetSequential switches a torrent between rarest first and in-order downloading
+func SetSequential(torrentID int, sequential bool) error {
+	t := GetTorrent(torrentID)
+	if t == nil {
+		return fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	t.mutex.Lock()
+	t.Sequential = sequential
+	t.mutex.Unlock()
+
+	cl := clientFor(t)
+	if cl != nil {
+		cl.picker.SetSequential(sequential)
+	}
+	return nil
+}
+
+// OpenFile returns a reader over a file of a torrent that is downloading
+func OpenFile(torrentID, fileIndex int) (*FileReader, error) {
+	t := GetTorrent(torrentID)
+	if t == nil {
+		return nil, fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	cl := clientFor(t)
+	if cl == nil {
+		return nil, fmt.Errorf("torrent %d is not downloading", torrentID)
+	}
+	return cl.NewFileReader(fileIndex)
+}
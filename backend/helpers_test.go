@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSession gives the test its own database and download directory
+func newTestSession(t *testing.T) {
+	t.Helper()
+
+	DatabasePath = filepath.Join(t.TempDir(), "gorrent.db")
+	DownloadDir = t.TempDir()
+	InitDB()
+	InitQueue(context.Background())
+	t.Cleanup(func() { db.Close() })
+}
+
+// addTestTorrent creates a torrent of the file or directory at path and
+// adds it to the session, removing it when the test ends
+func addTestTorrent(t *testing.T, path string, pieceLength int) *Torrent {
+	t.Helper()
+
+	metainfo, err := CreateTorrent(path, "", pieceLength, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, duplicate, err := AddMetainfo(metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate {
+		t.Fatal("torrent was already added")
+	}
+	t.Cleanup(func() { RemoveTorrent(torrent.ID, false) })
+	return torrent
+}
+
+// waitComplete waits up to timeout for the client to have every piece
+func waitComplete(cl *Client, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !cl.Complete() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// writeTestFile fills the file at path with n random bytes
+func writeTestFile(t *testing.T, path string, n int) []byte {
+	t.Helper()
+
+	data := make([]byte, n)
+	rand.Read(data)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// serveTestSeed plays a seed holding data on conn, after the handshakes,
+// until the connection closes
+func serveTestSeed(conn net.Conn, data []byte, pieceLength int) {
+	numPieces := (len(data) + pieceLength - 1) / pieceLength
+	bitfield := make(Bitfield, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bitfield.SetPiece(i)
+	}
+
+	for _, msg := range []*Message{{ID: MsgBitfield, Payload: bitfield}, {ID: MsgUnchoke}} {
+		_, err := conn.Write(msg.Serialize())
+		if err != nil {
+			return
+		}
+	}
+
+	for {
+		msg, err := Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != MsgRequest {
+			continue
+		}
+
+		index := binary.BigEndian.Uint32(msg.Payload[0:4])
+		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+		length := binary.BigEndian.Uint32(msg.Payload[8:12])
+		offset := int(index)*pieceLength + int(begin)
+
+		payload := append([]byte(nil), msg.Payload[0:8]...)
+		payload = append(payload, data[offset:offset+int(length)]...)
+		piece := Message{ID: MsgPiece, Payload: payload}
+		_, err = conn.Write(piece.Serialize())
+		if err != nil {
+			return
+		}
+	}
+}
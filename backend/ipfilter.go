@@ -0,0 +1,263 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The IP filter blocks address ranges read from a file, one entry per
+// line in any of these formats, optionally gzipped:
+//
+//	eMule ipfilter.dat  001.002.003.000 - 001.002.003.255 , 000 , Some Org
+//	PeerGuardian .p2p   Some Org:1.2.3.0-1.2.3.255
+//	CIDR list           1.2.3.0/24 or 2001:db8::/32, or a single address
+//
+// Lines starting with # or // are comments. As in eMule, dat entries with
+// an access level above 127 are allowed rather than blocked.
+
+// IPFilterStatus describes the loaded IP filter
+type IPFilterStatus struct {
+	Path   string `json:"path"`
+	Ranges int    `json:"ranges"`
+}
+
+// ipRange is an inclusive range of addresses of the same family
+type ipRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+var (
+	ipFilterPath string
+	// ipFilter holds sorted ranges that don't overlap or touch
+	ipFilter      []ipRange
+	ipFilterMutex sync.Mutex
+)
+
+func GetIPFilter() IPFilterStatus {
+	ipFilterMutex.Lock()
+	defer ipFilterMutex.Unlock()
+	return IPFilterStatus{Path: ipFilterPath, Ranges: len(ipFilter)}
+}
+
+// SetIPFilter loads the filter from path, an empty path clearing it. The
+// old filter stays if the file can't be loaded.
+func SetIPFilter(path string) error {
+	var ranges []ipRange
+	if path != "" {
+		var err error
+		ranges, err = loadIPFilter(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	ipFilterMutex.Lock()
+	ipFilterPath = path
+	ipFilter = ranges
+	ipFilterMutex.Unlock()
+	return nil
+}
+
+// ReloadIPFilter reads the filter file again, after it was updated
+func ReloadIPFilter() error {
+	ipFilterMutex.Lock()
+	path := ipFilterPath
+	ipFilterMutex.Unlock()
+
+	if path == "" {
+		return fmt.Errorf("no IP filter loaded")
+	}
+	return SetIPFilter(path)
+}
+
+// ipFiltered tells if the IP filter blocks ip
+func ipFiltered(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+
+	ipFilterMutex.Lock()
+	defer ipFilterMutex.Unlock()
+
+	// the first range ending at or after addr is the only one that can hold it
+	i := sort.Search(len(ipFilter), func(i int) bool {
+		return ipFilter[i].last.Compare(addr) >= 0
+	})
+	return i < len(ipFilter) && ipFilter[i].first.Compare(addr) <= 0
+}
+
+func loadIPFilter(path string) ([]ipRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var src io.Reader = r
+	magic, _ := r.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	var ranges []ipRange
+	skipped := 0
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		r, blocked, err := parseIPFilterLine(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 && skipped > 0 {
+		return nil, fmt.Errorf("no valid ranges in %s", path)
+	}
+
+	ranges = mergeRanges(ranges)
+	fmt.Printf("Loaded %d IP filter ranges from %s, skipped %d invalid lines\n", len(ranges), path, skipped)
+	return ranges, nil
+}
+
+// parseIPFilterLine reads the range of a line and whether it's blocked
+func parseIPFilterLine(line string) (ipRange, bool, error) {
+	// eMule: range , level , description. PeerGuardian descriptions may
+	// hold commas too, so only a numeric level makes it a dat line.
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err == nil {
+			r, err := parseIPRange(fields[0])
+			return r, level <= 127, err
+		}
+	}
+
+	if prefix, err := netip.ParsePrefix(line); err == nil {
+		return prefixRange(prefix), true, nil
+	}
+
+	r, err := parseIPRange(line)
+	if err == nil {
+		return r, true, nil
+	}
+	// PeerGuardian: description:range, the description may hold colons
+	i := strings.LastIndex(line, ":")
+	if i < 0 {
+		return ipRange{}, false, err
+	}
+	r, err = parseIPRange(line[i+1:])
+	return r, true, err
+}
+
+// parseIPRange reads "first - last" or a single address
+func parseIPRange(s string) (ipRange, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+
+	first, err := parseFilterAddr(from)
+	if err != nil {
+		return ipRange{}, err
+	}
+	last, err := parseFilterAddr(to)
+	if err != nil {
+		return ipRange{}, err
+	}
+	if first.Is4() != last.Is4() {
+		return ipRange{}, fmt.Errorf("range %q mixes IPv4 and IPv6", s)
+	}
+	if last.Less(first) {
+		first, last = last, first
+	}
+	return ipRange{first: first, last: last}, nil
+}
+
+// parseFilterAddr parses an address, allowing the zero padded IPv4 of
+// ipfilter.dat files
+func parseFilterAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, ":") {
+		octets := strings.Split(s, ".")
+		for i, octet := range octets {
+			if trimmed := strings.TrimLeft(octet, "0"); trimmed != "" {
+				octets[i] = trimmed
+			} else if octet != "" {
+				octets[i] = "0"
+			}
+		}
+		s = strings.Join(octets, ".")
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// prefixRange returns the addresses of a CIDR prefix
+func prefixRange(prefix netip.Prefix) ipRange {
+	if addr := prefix.Addr(); addr.Is4In6() {
+		prefix = netip.PrefixFrom(addr.Unmap(), max(prefix.Bits()-96, 0))
+	}
+	prefix = prefix.Masked()
+
+	first := prefix.Addr()
+	b := first.AsSlice()
+	for bit := prefix.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(b)
+	return ipRange{first: first, last: last}
+}
+
+// mergeRanges sorts ranges and joins those that overlap or touch
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first.Less(ranges[j].first)
+	})
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			next := prev.last.Next()
+			if r.first.Compare(prev.last) <= 0 || (next.IsValid() && next == r.first) {
+				if prev.last.Less(r.last) {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
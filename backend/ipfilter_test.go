@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"compress/gzip"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIPFilterLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		first   string
+		last    string
+		blocked bool
+		invalid bool
+	}{
+		// eMule ipfilter.dat
+		{line: "001.002.003.000 - 001.002.003.255 , 000 , Some Org", first: "1.2.3.0", last: "1.2.3.255", blocked: true},
+		{line: "010.000.000.000 - 010.255.255.255 , 200 , Allowed", first: "10.0.0.0", last: "10.255.255.255"},
+		{line: "001.002.003.000 - 001.002.003.255 , 127 , Some, Org", first: "1.2.3.0", last: "1.2.3.255", blocked: true},
+		// PeerGuardian .p2p
+		{line: "Some Org:1.2.3.0-1.2.3.255", first: "1.2.3.0", last: "1.2.3.255", blocked: true},
+		{line: "Foo, Inc:4.5.6.0-4.5.6.255", first: "4.5.6.0", last: "4.5.6.255", blocked: true},
+		{line: "Foo, Inc, 2 Ltd:4.5.6.0-4.5.6.255", first: "4.5.6.0", last: "4.5.6.255", blocked: true},
+		{line: "AS/400 Users: Home:7.8.9.0-7.8.9.127", first: "7.8.9.0", last: "7.8.9.127", blocked: true},
+		// CIDR lists and single addresses
+		{line: "1.2.3.0/24", first: "1.2.3.0", last: "1.2.3.255", blocked: true},
+		{line: "2001:db8::/32", first: "2001:db8::", last: "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", blocked: true},
+		{line: "::ffff:1.2.3.0/120", first: "1.2.3.0", last: "1.2.3.255", blocked: true},
+		{line: "5.6.7.8", first: "5.6.7.8", last: "5.6.7.8", blocked: true},
+		{line: "5.6.7.9 - 5.6.7.1", first: "5.6.7.1", last: "5.6.7.9", blocked: true},
+		// broken lines
+		{line: "Foo, Inc:4.5.6.0-4.5.6.999", invalid: true},
+		{line: "1.2.3.0/33", invalid: true},
+		{line: "1.2.3.0 - ::1 , 0 , Mixed", invalid: true},
+		{line: "no address here", invalid: true},
+	}
+
+	for _, test := range tests {
+		r, blocked, err := parseIPFilterLine(test.line)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: got %v-%v, want an error", test.line, r.first, r.last)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		want := ipRange{first: netip.MustParseAddr(test.first), last: netip.MustParseAddr(test.last)}
+		if r != want || blocked != test.blocked {
+			t.Errorf("%q: got %v-%v blocked %v, want %v-%v blocked %v",
+				test.line, r.first, r.last, blocked, want.first, want.last, test.blocked)
+		}
+	}
+}
+
+func TestLoadIPFilter(t *testing.T) {
+	lines := "# comment\n" +
+		"// another comment\n" +
+		"\n" +
+		"001.002.003.000 - 001.002.003.255 , 000 , Some Org\n" +
+		"010.000.000.000 - 010.255.255.255 , 200 , Allowed\n" +
+		"Foo, Inc:1.2.4.0-1.2.4.255\n" +
+		"2001:db8::/32\n" +
+		"not a range\n"
+
+	plain := filepath.Join(t.TempDir(), "filter.txt")
+	err := os.WriteFile(plain, []byte(lines), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzipped := filepath.Join(t.TempDir(), "filter.gz")
+	f, err := os.Create(gzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(lines))
+	gz.Close()
+	f.Close()
+
+	t.Cleanup(func() { SetIPFilter("") })
+	for _, path := range []string{plain, gzipped} {
+		err = SetIPFilter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the two touching IPv4 ranges are merged
+		if status := GetIPFilter(); status.Ranges != 2 || status.Path != path {
+			t.Errorf("%s: got %+v, want 2 ranges", filepath.Base(path), status)
+		}
+
+		for ip, want := range map[string]bool{
+			"1.2.3.0":         true,
+			"1.2.4.255":       true,
+			"::ffff:1.2.4.7":  true,
+			"1.2.5.0":         false,
+			"10.1.2.3":        false,
+			"2001:db8:1::1":   true,
+			"2001:db9::1":     false,
+			"not an address!": false,
+		} {
+			if got := ipFiltered(ip); got != want {
+				t.Errorf("%s: ipFiltered(%s) = %v, want %v", filepath.Base(path), ip, got, want)
+			}
+		}
+	}
+}
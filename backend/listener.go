@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ListenPort is the port peers connect to. 0 picks a free one, and
+// StartPeerListener then sets it to the port it got.
+var ListenPort = 6881
+
+// StartPeerListener accepts peers on ListenPort, over IPv6 and IPv4 where
+// the system supports dual-stack sockets
+func StartPeerListener() error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(ListenPort)))
+	if err != nil {
+		return err
+	}
+	ListenPort = listener.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				fmt.Println("Peer listener stopped:", err)
+				return
+			}
+			go acceptPeer(conn)
+		}
+	}()
+	return nil
+}
+
+// acceptPeer answers the handshake of an incoming peer for one of our
+// running torrents
+func acceptPeer(conn net.Conn) {
+	defer conn.Close()
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || ipFiltered(host) {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	c, encrypted, err := acceptEncryption(conn, GetEncryptionPolicy())
+	if err != nil {
+		return
+	}
+
+	receivedHS, err := readHandshake(c)
+	if err != nil {
+		return
+	}
+
+	t := findTorrent(receivedHS.infoHash)
+	if t == nil {
+		return
+	}
+	cl := clientFor(t)
+	if cl == nil {
+		return
+	}
+
+	peer := newIncomingPeer(conn.RemoteAddr())
+	if peer == nil || isBanned(peer.IP) {
+		return
+	}
+	if !reserveConnection(cl, false) {
+		return
+	}
+	defer releaseConnection(cl)
+
+	ctx := cl.runContext()
+	if ctx == nil {
+		return
+	}
+	defer closeOnDone(ctx, conn)()
+
+	hs := &Handshake{
+		infoHash: receivedHS.infoHash,
+		peerID:   peerID,
+	}
+	_, err = c.Write(hs.Serialize())
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	peer.Encrypted = encrypted
+	runPeer(cl, c, peer, receivedHS)
+}
+
+// acceptEncryption tells plaintext connections from encrypted ones by
+// their first bytes, and answers the encryption handshake as policy allows
+func acceptEncryption(conn net.Conn, policy string) (net.Conn, bool, error) {
+	r := bufio.NewReader(conn)
+
+	if isPlaintextHandshake(r) {
+		if policy == EncryptionRequire {
+			return nil, false, fmt.Errorf("plaintext connection refused")
+		}
+		return &bufferedConn{Conn: conn, r: r}, false, nil
+	}
+
+	if policy == EncryptionDisabled {
+		return nil, false, fmt.Errorf("encrypted connection refused")
+	}
+	return mseRespond(conn, r, findSKEY, policy != EncryptionRequire)
+}
+
+func newIncomingPeer(addr net.Addr) *Peer {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	// IPv4 peers on a dual-stack socket show up as ::ffff:a.b.c.d
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	transport := TransportTCP
+	if _, ok := addr.(*net.UDPAddr); ok {
+		transport = TransportUTP
+	}
+
+	return &Peer{
+		IP:           ip.String(),
+		Port:         port,
+		PeerChoked:   true,
+		ClientChoked: true,
+		Direction:    PeerIncoming,
+		Source:       PeerSourceIncoming,
+		Transport:    transport,
+	}
+}
+
+// localAddresses returns our public IPv4 and global IPv6 address, if the
+// machine has them
+func localAddresses() (string, string) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", ""
+	}
+
+	var ipv4, ipv6 string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+
+		if ipNet.IP.To4() != nil {
+			if ipv4 == "" {
+				ipv4 = ipNet.IP.String()
+			}
+		} else if ipv6 == "" {
+			ipv6 = ipNet.IP.String()
+		}
+	}
+	return ipv4, ipv6
+}
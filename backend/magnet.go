@@ -0,0 +1,375 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	// metadataTimeout bounds finding peers and fetching the metadata of a
+	// magnet link
+	metadataTimeout = 2 * time.Minute
+	// metadataPeerTimeout is how long a peer has to send the whole metadata
+	// once connected
+	metadataPeerTimeout = 30 * time.Second
+	// metadataConnections is how many peers are asked at once
+	metadataConnections = 5
+	// magnetAnnounceTimeout bounds the announce to each tracker of a magnet link
+	magnetAnnounceTimeout = 15 * time.Second
+	// magnetLeft is the left we announce without the metadata. Like
+	// libtorrent we say 16 KiB, so trackers count us as a leecher.
+	magnetLeft = 16 << 10
+)
+
+// Magnet is what a magnet link tells about a torrent
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	WebSeeds []string
+	// Peers are the host:port addresses given with x.pe
+	Peers []string
+}
+
+// ParseMagnet reads a magnet link with a BitTorrent info hash, in hex or base32
+func ParseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link")
+	}
+
+	q := u.Query()
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		WebSeeds: q["ws"],
+		Peers:    q["x.pe"],
+	}
+	for _, xt := range q["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+
+		var b []byte
+		switch len(hash) {
+		case 40:
+			b, err = hex.DecodeString(hash)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("invalid info hash %q", hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		copy(m.InfoHash[:], b)
+		return m, nil
+	}
+	return nil, fmt.Errorf("magnet link has no BitTorrent info hash")
+}
+
+// HandleMagnet adds the torrent of a magnet link once its metadata has been
+// fetched from peers (BEP 9). The peers come from the link's trackers and
+// x.pe addresses, and the torrent's client starts out with them.
+func HandleMagnet(ctx context.Context, link string) (*Torrent, bool, error) {
+	m, err := ParseMagnet(link)
+	if err != nil {
+		return nil, false, err
+	}
+	if t := findTorrent(m.InfoHash); t != nil {
+		return t, true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	peers := magnetPeers(ctx, m)
+	if len(peers) == 0 {
+		return nil, false, fmt.Errorf("no peers found for %x", m.InfoHash)
+	}
+	info, err := fetchMetadata(ctx, m.InfoHash, peers)
+	if err != nil {
+		return nil, false, err
+	}
+
+	metainfo, err := magnetMetainfo(m, info)
+	if err != nil {
+		return nil, false, err
+	}
+	t, duplicate, err := AddMetainfo(metainfo)
+	if err != nil || duplicate {
+		return t, duplicate, err
+	}
+
+	t.mutex.Lock()
+	t.magnetPeers = peers
+	t.mutex.Unlock()
+	return t, false, nil
+}
+
+// takeMagnetPeers returns the peers found for a magnet link, once
+func (t *Torrent) takeMagnetPeers() []*Peer {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	peers := t.magnetPeers
+	t.magnetPeers = nil
+	return peers
+}
+
+// magnetPeers collects the peers a magnet link lists and those its
+// trackers know of, leaving out the ones we wouldn't connect to
+func magnetPeers(ctx context.Context, m *Magnet) []*Peer {
+	var peers []*Peer
+	for _, addr := range m.Peers {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			fmt.Printf("Invalid peer address %q in magnet link\n", addr)
+			continue
+		}
+		peers = append(peers, &Peer{
+			IP:           host,
+			Port:         port,
+			PeerChoked:   true,
+			ClientChoked: true,
+			Direction:    PeerOutgoing,
+			Source:       PeerSourceMagnet,
+		})
+	}
+
+	for _, tracker := range m.Trackers {
+		tr, err := announceMagnet(ctx, tracker, m.InfoHash)
+		if err != nil {
+			fmt.Printf("Error announcing to %s: %v\n", tracker, err)
+			continue
+		}
+		found, err := parseCompactPeers(tr.Peers, net.IPv4len)
+		if err != nil {
+			fmt.Println("Error parsing peers:", err)
+		}
+		peers = append(peers, found...)
+		found, err = parseCompactPeers(tr.Peers6, net.IPv6len)
+		if err != nil {
+			fmt.Println("Error parsing IPv6 peers:", err)
+		}
+		peers = append(peers, found...)
+	}
+
+	seen := make(map[string]bool)
+	var usable []*Peer
+	for _, p := range peers {
+		if seen[p.String()] || ipFiltered(p.IP) || isBanned(p.IP) {
+			continue
+		}
+		seen[p.String()] = true
+		usable = append(usable, p)
+	}
+	return usable
+}
+
+// announceMagnet asks a tracker for the peers of a torrent we only know the
+// info hash of
+func announceMagnet(ctx context.Context, tracker string, infoHash [20]byte) (*TrackerResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, magnetAnnounceTimeout)
+	defer cancel()
+
+	bt := &BencodeTorrent{Announce: tracker}
+	bt.Info.infoHash = infoHash
+	trackerUrl, err := getTrackerURL(bt, newAnnounceKey(), 0, 0, magnetLeft, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return requestTracker(ctx, trackerUrl)
+}
+
+// fetchMetadata asks the peers for the info dictionary of infoHash, a few
+// at a time, until one of them sends it
+func fetchMetadata(ctx context.Context, infoHash [20]byte, peers []*Peer) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// failed peers send nil
+	results := make(chan []byte, len(peers))
+	slots := make(chan struct{}, metadataConnections)
+	for _, p := range peers {
+		go func(p *Peer) {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results <- nil
+				return
+			}
+			defer func() { <-slots }()
+
+			info, err := fetchMetadataFrom(ctx, p, infoHash)
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("Error fetching metadata from %s: %v\n", p.String(), err)
+			}
+			results <- info
+		}(p)
+	}
+
+	for range peers {
+		select {
+		case info := <-results:
+			if info != nil {
+				return info, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("none of the %d peers sent the metadata", len(peers))
+}
+
+// fetchMetadataFrom downloads the info dictionary of infoHash from a peer
+// supporting ut_metadata
+func fetchMetadataFrom(ctx context.Context, peer *Peer, infoHash [20]byte) ([]byte, error) {
+	conn, hs, err := openPeerConn(ctx, peer, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	if hs.peerID == peerID {
+		return nil, fmt.Errorf("connected to ourselves")
+	}
+	return requestMetadata(conn, peer, hs, infoHash)
+}
+
+// requestMetadata runs the metadata exchange on a connection whose
+// handshakes are done, and checks what arrived against the info hash
+func requestMetadata(conn net.Conn, peer *Peer, hs *Handshake, infoHash [20]byte) ([]byte, error) {
+	if hs.reserved[5]&extensionBit == 0 {
+		return nil, fmt.Errorf("peer doesn't support extensions")
+	}
+	conn.SetDeadline(time.Now().Add(metadataPeerTimeout))
+
+	err := sendExtended(conn, peer, extHandshakeID, extHandshake{M: map[string]int{"ut_metadata": utMetadataID}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var info []byte
+	var received []bool
+	remaining := 0
+	for {
+		msg, err := Read(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != MsgExtended || len(msg.Payload) == 0 {
+			continue
+		}
+
+		switch msg.Payload[0] {
+		case extHandshakeID:
+			if info != nil {
+				continue
+			}
+			var ext extHandshake
+			err = bencode.Unmarshal(bytes.NewReader(msg.Payload[1:]), &ext)
+			if err != nil {
+				return nil, err
+			}
+			id := ext.M["ut_metadata"]
+			if id == 0 {
+				return nil, fmt.Errorf("peer doesn't serve metadata")
+			}
+			if ext.MetadataSize <= 0 || ext.MetadataSize > maxMetadataSize {
+				return nil, fmt.Errorf("invalid metadata size %d", ext.MetadataSize)
+			}
+
+			info = make([]byte, ext.MetadataSize)
+			remaining = (len(info) + metadataPieceSize - 1) / metadataPieceSize
+			received = make([]bool, remaining)
+			for i := range received {
+				err = sendExtended(conn, peer, id, metadataMessage{MsgType: metadataRequest, Piece: i}, nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case utMetadataID:
+			if info == nil {
+				continue
+			}
+			m, data, err := parseMetadataMessage(msg.Payload[1:])
+			if err != nil {
+				return nil, err
+			}
+			if m.MsgType == metadataReject {
+				return nil, fmt.Errorf("peer rejected the request for metadata piece %d", m.Piece)
+			}
+			if m.MsgType != metadataData || m.Piece < 0 || m.Piece >= len(received) || received[m.Piece] {
+				continue
+			}
+
+			start := m.Piece * metadataPieceSize
+			end := min(start+metadataPieceSize, len(info))
+			if len(data) != end-start {
+				return nil, fmt.Errorf("metadata piece %d has %d bytes, want %d", m.Piece, len(data), end-start)
+			}
+			copy(info[start:], data)
+			received[m.Piece] = true
+			remaining--
+			if remaining > 0 {
+				continue
+			}
+
+			if sha1.Sum(info) != infoHash {
+				return nil, fmt.Errorf("metadata doesn't match the info hash")
+			}
+			return info, nil
+		}
+	}
+}
+
+// magnetMetainfo builds a .torrent file around the info dictionary fetched
+// for a magnet link, with the link's trackers and web seeds
+func magnetMetainfo(m *Magnet, info []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	put := func(key string, value interface{}) {
+		if err == nil {
+			err = bencode.Marshal(&buf, key)
+		}
+		if err == nil {
+			err = bencode.Marshal(&buf, value)
+		}
+	}
+
+	// keys go in sorted order, the info dictionary exactly as it was hashed
+	buf.WriteString("d")
+	if len(m.Trackers) > 0 {
+		// each tracker gets a tier of its own
+		tiers := make([][]string, len(m.Trackers))
+		for i, tracker := range m.Trackers {
+			tiers[i] = []string{tracker}
+		}
+		put("announce", m.Trackers[0])
+		put("announce-list", tiers)
+	}
+	buf.WriteString("4:info")
+	buf.Write(info)
+	if len(m.WebSeeds) > 0 {
+		put("url-list", m.WebSeeds)
+	}
+	buf.WriteString("e")
+	return buf.Bytes(), err
+}
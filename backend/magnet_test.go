@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	hexHash := hex.EncodeToString(infoHash[:])
+	base32Hash := base32.StdEncoding.EncodeToString(infoHash[:])
+
+	tests := []struct {
+		link string
+		want *Magnet
+	}{
+		{
+			"magnet:?xt=urn:btih:" + hexHash + "&dn=debian.iso&tr=http%3A%2F%2Ftracker.example%2Fannounce" +
+				"&tr=http://backup.example/announce&ws=http://mirror.example/debian.iso&x.pe=192.0.2.1:6881&x.pe=[2001:db8::1]:6881",
+			&Magnet{
+				InfoHash: infoHash,
+				Name:     "debian.iso",
+				Trackers: []string{"http://tracker.example/announce", "http://backup.example/announce"},
+				WebSeeds: []string{"http://mirror.example/debian.iso"},
+				Peers:    []string{"192.0.2.1:6881", "[2001:db8::1]:6881"},
+			},
+		},
+		{"magnet:?xt=urn:btih:" + strings.ToUpper(hexHash), &Magnet{InfoHash: infoHash}},
+		{"magnet:?xt=urn:btih:" + base32Hash, &Magnet{InfoHash: infoHash}},
+		{"magnet:?xt=urn:btih:" + strings.ToLower(base32Hash), &Magnet{InfoHash: infoHash}},
+		{"magnet:?xt=urn:btmh:1220" + hexHash + "&xt=urn:btih:" + hexHash, &Magnet{InfoHash: infoHash}},
+		{"http://tracker.example/file.torrent", nil},
+		{"magnet:?dn=name", nil},
+		{"magnet:?xt=urn:btih:deadbeef", nil},
+		{"magnet:?xt=urn:btih:" + hexHash[:38] + "zz", nil},
+	}
+	for _, test := range tests {
+		got, err := ParseMagnet(test.link)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", test.link, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.link, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.link, got, test.want)
+		}
+	}
+}
+
+// fetchTestMetadata runs the metadata exchange against a seeding client's
+// peer loop, checking the result against infoHash
+func fetchTestMetadata(cl *Client, infoHash [20]byte) ([]byte, error) {
+	local, remote := net.Pipe()
+
+	var reserved [8]byte
+	reserved[5] = extensionBit
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hs := &Handshake{infoHash: cl.Torrent.bencodeTorrent.Info.hash(), peerID: [20]byte{'-', 'T', 'T', 1}, reserved: reserved}
+		runPeer(cl, remote, &Peer{IP: "127.0.0.2", Port: "6881"}, hs)
+	}()
+	defer func() { <-done }()
+	defer local.Close()
+
+	return requestMetadata(local, &Peer{}, &Handshake{reserved: reserved}, infoHash)
+}
+
+func TestMetadataExchange(t *testing.T) {
+	newTestSession(t)
+
+	// enough pieces that the info dictionary takes two metadata pieces
+	const pieceLength = 16 << 10
+	src := filepath.Join(t.TempDir(), "metadata.bin")
+	writeTestFile(t, src, 900*pieceLength)
+	torrent := addTestTorrent(t, src, pieceLength)
+	raw := torrent.bencodeTorrent.Info.raw
+	if len(raw) <= metadataPieceSize {
+		t.Fatalf("info dictionary of %d bytes fits in one metadata piece", len(raw))
+	}
+	cl := Enqueue(torrent)
+	infoHash := torrent.bencodeTorrent.Info.hash()
+
+	info, err := fetchTestMetadata(cl, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(info, raw) {
+		t.Fatal("fetched metadata differs from the info dictionary")
+	}
+
+	// metadata for another info hash is refused
+	_, err = fetchTestMetadata(cl, [20]byte{1})
+	if err == nil {
+		t.Error("metadata not matching the info hash was accepted")
+	}
+
+	// the .torrent built around it is the same torrent, with the magnet
+	// link's trackers and web seeds
+	m := &Magnet{
+		InfoHash: infoHash,
+		Trackers: []string{"http://tracker.example/announce", "http://backup.example/announce"},
+		WebSeeds: []string{"http://mirror.example/metadata.bin"},
+	}
+	metainfo, err := magnetMetainfo(m, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := getBencode(bytes.NewReader(metainfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.Info.hash() != infoHash || bt.Info.Name != "metadata.bin" {
+		t.Errorf("built torrent %q has another info hash", bt.Info.Name)
+	}
+	if bt.Announce != m.Trackers[0] || !reflect.DeepEqual(bt.webSeeds, m.WebSeeds) {
+		t.Errorf("built torrent announces to %q with web seeds %v", bt.Announce, bt.webSeeds)
+	}
+
+	// a magnet link of a loaded torrent is a duplicate, without asking peers
+	got, duplicate, err := HandleMagnet(context.Background(), "magnet:?xt=urn:btih:"+torrent.InfoHash())
+	if err != nil || !duplicate || got != torrent {
+		t.Errorf("adding the magnet link of a loaded torrent: got %v, %t, %v", got, duplicate, err)
+	}
+}
+
+func TestPrivateMetadata(t *testing.T) {
+	newTestSession(t)
+
+	src := filepath.Join(t.TempDir(), "private.bin")
+	writeTestFile(t, src, 20000)
+	metainfo, err := CreateTorrent(src, "", 16<<10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, _, err := AddMetainfo(metainfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { RemoveTorrent(torrent.ID, false) })
+	cl := Enqueue(torrent)
+
+	_, err = fetchTestMetadata(cl, torrent.bencodeTorrent.Info.hash())
+	if err == nil {
+		t.Error("the metadata of a private torrent was served")
+	}
+}
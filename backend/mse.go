@@ -0,0 +1,400 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"sync"
+)
+
+// Message Stream Encryption, as specified at
+// https://wiki.vuze.com/w/Message_Stream_Encryption
+
+const (
+	EncryptionPrefer   = "prefer"
+	EncryptionRequire  = "require"
+	EncryptionTolerate = "tolerate"
+	EncryptionDisabled = "disabled"
+)
+
+var (
+	encryptionPolicy = EncryptionPrefer
+	encryptionMutex  sync.Mutex
+)
+
+// crypto_provide and crypto_select bits
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+const (
+	mseKeyLength = 96
+	mseMaxPad    = 512
+	// rc4Discard is how much of each RC4 keystream is thrown away
+	rc4Discard = 1024
+)
+
+var (
+	msePrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseGenerator = big.NewInt(2)
+	// mseVC is the verification constant both sides encrypt
+	mseVC = make([]byte, 8)
+)
+
+func GetEncryptionPolicy() string {
+	encryptionMutex.Lock()
+	defer encryptionMutex.Unlock()
+	return encryptionPolicy
+}
+
+// SetEncryptionPolicy sets whether peer connections are encrypted: prefer
+// tries encryption and falls back to plaintext, require drops peers that
+// won't encrypt, tolerate dials in plaintext but accepts encrypted peers and
+// disabled only speaks plaintext
+func SetEncryptionPolicy(policy string) error {
+	switch policy {
+	case EncryptionPrefer, EncryptionRequire, EncryptionTolerate, EncryptionDisabled:
+	default:
+		return fmt.Errorf("invalid encryption policy %q", policy)
+	}
+
+	encryptionMutex.Lock()
+	encryptionPolicy = policy
+	encryptionMutex.Unlock()
+	return nil
+}
+
+// bufferedConn is a connection whose reads go through r, for bytes that
+// were already peeked or decrypted
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// rc4Conn encrypts everything written and decrypts everything read
+type rc4Conn struct {
+	net.Conn
+	r       io.Reader
+	encrypt *rc4.Cipher
+	decrypt *rc4.Cipher
+	mutex   sync.Mutex
+}
+
+func (c *rc4Conn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.decrypt.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (c *rc4Conn) Write(p []byte) (int, error) {
+	// the keystream must be applied in the order bytes hit the wire
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	buf := make([]byte, len(p))
+	c.encrypt.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+type mseKeys struct {
+	private *big.Int
+	public  []byte
+}
+
+func newMSEKeys() (*mseKeys, error) {
+	x := make([]byte, 20)
+	_, err := rand.Read(x)
+	if err != nil {
+		return nil, err
+	}
+
+	private := new(big.Int).SetBytes(x)
+	public := new(big.Int).Exp(mseGenerator, private, msePrime)
+	return &mseKeys{private: private, public: padKey(public)}, nil
+}
+
+// secret computes the shared secret S from the other side's public key
+func (k *mseKeys) secret(remote []byte) []byte {
+	y := new(big.Int).SetBytes(remote)
+	return padKey(new(big.Int).Exp(y, k.private, msePrime))
+}
+
+func padKey(n *big.Int) []byte {
+	buf := make([]byte, mseKeyLength)
+	return n.FillBytes(buf)
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newMSECipher returns the RC4 stream for keyA or keyB
+func newMSECipher(name string, secret []byte, skey [20]byte) *rc4.Cipher {
+	c, err := rc4.NewCipher(mseHash([]byte(name), secret, skey[:]))
+	if err != nil {
+		panic(err)
+	}
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	pad := make([]byte, mrand.Intn(mseMaxPad+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// syncTo reads until pattern has been seen, giving up after limit bytes
+func syncTo(r io.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	b := make([]byte, 1)
+	for len(window) < limit {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return err
+		}
+		window = append(window, b[0])
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("encryption handshake out of sync")
+}
+
+// mseInitiate encrypts an outgoing connection. The payload, our BitTorrent
+// handshake, is sent as part of the encryption handshake.
+func mseInitiate(conn net.Conn, infoHash [20]byte, payload []byte, provide uint32) (net.Conn, bool, error) {
+	keys, err := newMSEKeys()
+	if err != nil {
+		return nil, false, err
+	}
+
+	pad, err := randomPad()
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = conn.Write(append(append([]byte(nil), keys.public...), pad...))
+	if err != nil {
+		return nil, false, err
+	}
+
+	r := bufio.NewReader(conn)
+	remote := make([]byte, mseKeyLength)
+	_, err = io.ReadFull(r, remote)
+	if err != nil {
+		return nil, false, err
+	}
+	secret := keys.secret(remote)
+
+	encrypt := newMSECipher("keyA", secret, infoHash)
+	decrypt := newMSECipher("keyB", secret, infoHash)
+
+	var msg bytes.Buffer
+	msg.Write(mseHash([]byte("req1"), secret))
+	msg.Write(xorBytes(mseHash([]byte("req2"), infoHash[:]), mseHash([]byte("req3"), secret)))
+
+	var plain bytes.Buffer
+	plain.Write(mseVC)
+	binary.Write(&plain, binary.BigEndian, provide)
+	binary.Write(&plain, binary.BigEndian, uint16(0))
+	binary.Write(&plain, binary.BigEndian, uint16(len(payload)))
+	plain.Write(payload)
+
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	msg.Write(encrypted)
+
+	_, err = conn.Write(msg.Bytes())
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the answer starts with the encrypted VC after the other side's padding
+	vc := make([]byte, len(mseVC))
+	newMSECipher("keyB", secret, infoHash).XORKeyStream(vc, mseVC)
+	err = syncTo(r, vc, mseMaxPad+len(vc))
+	if err != nil {
+		return nil, false, err
+	}
+	decrypt.XORKeyStream(vc, vc)
+
+	header := make([]byte, 6)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, false, err
+	}
+	decrypt.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header[0:4])
+	padLength := int(binary.BigEndian.Uint16(header[4:6]))
+	if padLength > mseMaxPad {
+		return nil, false, fmt.Errorf("invalid encryption padding")
+	}
+
+	pad = make([]byte, padLength)
+	_, err = io.ReadFull(r, pad)
+	if err != nil {
+		return nil, false, err
+	}
+	decrypt.XORKeyStream(pad, pad)
+
+	switch {
+	case selected == cryptoRC4 && provide&cryptoRC4 != 0:
+		return &rc4Conn{Conn: conn, r: r, encrypt: encrypt, decrypt: decrypt}, true, nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return &bufferedConn{Conn: conn, r: r}, false, nil
+	default:
+		return nil, false, fmt.Errorf("peer selected unsupported encryption %d", selected)
+	}
+}
+
+// mseRespond answers the encryption handshake of an incoming connection.
+// The torrent is recognized by its info hash, findSKEY returning the one
+// whose req2 hash matches. The peer's initial payload is read back first
+// by the returned connection.
+func mseRespond(conn net.Conn, r io.Reader, findSKEY func(req2 []byte) ([20]byte, bool), allowPlaintext bool) (net.Conn, bool, error) {
+	remote := make([]byte, mseKeyLength)
+	_, err := io.ReadFull(r, remote)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keys, err := newMSEKeys()
+	if err != nil {
+		return nil, false, err
+	}
+	pad, err := randomPad()
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = conn.Write(append(append([]byte(nil), keys.public...), pad...))
+	if err != nil {
+		return nil, false, err
+	}
+	secret := keys.secret(remote)
+
+	err = syncTo(r, mseHash([]byte("req1"), secret), mseMaxPad+sha1.Size)
+	if err != nil {
+		return nil, false, err
+	}
+
+	obfuscated := make([]byte, sha1.Size)
+	_, err = io.ReadFull(r, obfuscated)
+	if err != nil {
+		return nil, false, err
+	}
+	skey, ok := findSKEY(xorBytes(obfuscated, mseHash([]byte("req3"), secret)))
+	if !ok {
+		return nil, false, fmt.Errorf("encrypted connection for an unknown torrent")
+	}
+
+	decrypt := newMSECipher("keyA", secret, skey)
+	encrypt := newMSECipher("keyB", secret, skey)
+
+	header := make([]byte, 14)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, false, err
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[0:8], mseVC) {
+		return nil, false, fmt.Errorf("invalid encryption verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLength := int(binary.BigEndian.Uint16(header[12:14]))
+	if padLength > mseMaxPad {
+		return nil, false, fmt.Errorf("invalid encryption padding")
+	}
+
+	rest := make([]byte, padLength+2)
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return nil, false, err
+	}
+	decrypt.XORKeyStream(rest, rest)
+
+	payload := make([]byte, binary.BigEndian.Uint16(rest[padLength:]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, false, err
+	}
+	decrypt.XORKeyStream(payload, payload)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && allowPlaintext:
+		selected = cryptoPlaintext
+	default:
+		return nil, false, fmt.Errorf("no acceptable encryption offered")
+	}
+
+	answer := make([]byte, 14)
+	copy(answer, mseVC)
+	binary.BigEndian.PutUint32(answer[8:12], selected)
+	encrypt.XORKeyStream(answer, answer)
+	_, err = conn.Write(answer)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if selected == cryptoPlaintext {
+		return &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(payload), r)}, false, nil
+	}
+
+	c := &rc4Conn{Conn: conn, r: r, encrypt: encrypt, decrypt: decrypt}
+	return &bufferedConn{Conn: c, r: io.MultiReader(bytes.NewReader(payload), c)}, true, nil
+}
+
+// findSKEY returns the info hash of the running torrent matching an
+// incoming encrypted connection
+func findSKEY(req2 []byte) ([20]byte, bool) {
+	torrentsMutex.Lock()
+	defer torrentsMutex.Unlock()
+
+	for _, t := range torrents {
+		if t.bencodeTorrent == nil {
+			continue
+		}
+		infoHash := t.bencodeTorrent.Info.hash()
+		if bytes.Equal(mseHash([]byte("req2"), infoHash[:]), req2) {
+			return infoHash, true
+		}
+	}
+	return [20]byte{}, false
+}
+
+// isPlaintextHandshake tells if a connection starts with a regular
+// BitTorrent handshake rather than an encryption handshake
+func isPlaintextHandshake(r *bufio.Reader) bool {
+	header, err := r.Peek(20)
+	return err == nil && header[0] == 19 && string(header[1:20]) == "BitTorrent protocol"
+}
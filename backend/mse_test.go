@@ -0,0 +1,220 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tapConn keeps a copy of everything written to the wire
+type tapConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	c.written.Write(p)
+	c.mutex.Unlock()
+	return c.Conn.Write(p)
+}
+
+type mseResult struct {
+	dialEncrypted   bool
+	acceptEncrypted bool
+	attempts        int
+	err             error
+}
+
+// mseConnect dials one end of a net.Pipe under dialPolicy and accepts the
+// other under acceptPolicy, falling back to plaintext like openPeerConn. It
+// checks both handshakes and a message each way get through.
+func mseConnect(infoHash [20]byte, dialPolicy, acceptPolicy string) mseResult {
+	var result mseResult
+	provide := encryptionProvide(dialPolicy)
+	if provide != 0 {
+		result = mseAttempt(infoHash, provide, acceptPolicy)
+		if result.err == nil || provide&cryptoPlaintext == 0 {
+			return result
+		}
+	}
+	fallback := mseAttempt(infoHash, 0, acceptPolicy)
+	fallback.attempts += result.attempts
+	return fallback
+}
+
+func mseAttempt(infoHash [20]byte, provide uint32, acceptPolicy string) mseResult {
+	client, server := net.Pipe()
+	defer client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+
+	accepted := make(chan mseResult, 1)
+	go func() {
+		defer server.Close()
+		var result mseResult
+		defer func() { accepted <- result }()
+
+		c, encrypted, err := acceptEncryption(server, acceptPolicy)
+		if err != nil {
+			result.err = err
+			return
+		}
+		result.acceptEncrypted = encrypted
+		hs, err := readHandshake(c)
+		if err != nil {
+			result.err = err
+			return
+		}
+		_, err = c.Write(hs.Serialize())
+		if err != nil {
+			result.err = err
+			return
+		}
+		// echo the dialing side's message
+		msg := make([]byte, 5)
+		_, err = io.ReadFull(c, msg)
+		if err == nil {
+			_, err = c.Write(msg)
+		}
+		result.err = err
+	}()
+
+	result := mseResult{attempts: 1}
+	tap := &tapConn{Conn: client}
+	hs := &Handshake{infoHash: infoHash, peerID: peerID}
+	var c net.Conn = tap
+	var err error
+	if provide != 0 {
+		c, result.dialEncrypted, err = mseInitiate(tap, infoHash, hs.Serialize(), provide)
+	} else {
+		_, err = tap.Write(hs.Serialize())
+	}
+
+	if err == nil {
+		var received *Handshake
+		received, err = readHandshake(c)
+		if err == nil && received.infoHash != infoHash {
+			err = fmt.Errorf("info hash mismatch")
+		}
+	}
+	if err == nil {
+		_, err = c.Write([]byte("hello"))
+	}
+	if err == nil {
+		echo := make([]byte, 5)
+		_, err = io.ReadFull(c, echo)
+		if err == nil && string(echo) != "hello" {
+			err = fmt.Errorf("echo got %q", echo)
+		}
+	}
+	client.Close()
+
+	acceptResult := <-accepted
+	result.acceptEncrypted = acceptResult.acceptEncrypted
+	if err == nil {
+		err = acceptResult.err
+	}
+	if err == nil && result.dialEncrypted == bytes.Contains(tap.written.Bytes(), []byte("BitTorrent protocol")) {
+		err = fmt.Errorf("encrypted is %t but the wire says otherwise", result.dialEncrypted)
+	}
+	result.err = err
+	return result
+}
+
+func TestEncryptionPolicies(t *testing.T) {
+	newTestSession(t)
+
+	src := filepath.Join(t.TempDir(), "mse.bin")
+	writeTestFile(t, src, 20000)
+	infoHash := addTestTorrent(t, src, 16<<10).bencodeTorrent.Info.hash()
+
+	const (
+		rc4 = iota
+		plaintext
+		fallback
+		refused
+	)
+	policies := []string{EncryptionPrefer, EncryptionRequire, EncryptionTolerate, EncryptionDisabled}
+	// want[dial][accept], in the order of policies
+	want := [][]int{
+		{rc4, rc4, rc4, fallback},
+		{rc4, rc4, rc4, refused},
+		{plaintext, refused, plaintext, plaintext},
+		{plaintext, refused, plaintext, plaintext},
+	}
+
+	for i, dial := range policies {
+		for j, accept := range policies {
+			t.Run(dial+"-"+accept, func(t *testing.T) {
+				// padding lengths are random, so go through a few to
+				// exercise the VC and req1 sync
+				for n := 0; n < 8; n++ {
+					result := mseConnect(infoHash, dial, accept)
+					switch want[i][j] {
+					case refused:
+						if result.err == nil {
+							t.Fatal("connected, want refused")
+						}
+						continue
+					case fallback:
+						if result.attempts != 2 {
+							t.Errorf("made %d attempts, want an encrypted one then plaintext", result.attempts)
+						}
+					}
+					if result.err != nil {
+						t.Fatal(result.err)
+					}
+					encrypted := want[i][j] == rc4
+					if result.dialEncrypted != encrypted || result.acceptEncrypted != encrypted {
+						t.Fatalf("encrypted %t/%t, want %t", result.dialEncrypted, result.acceptEncrypted, encrypted)
+					}
+				}
+			})
+		}
+	}
+
+	// an encrypted connection for a torrent we don't have is refused
+	var unknown [20]byte
+	rand.Read(unknown[:])
+	if result := mseConnect(unknown, EncryptionRequire, EncryptionPrefer); result.err == nil {
+		t.Error("encrypted connection for an unknown torrent was accepted")
+	}
+}
+
+func TestSyncTo(t *testing.T) {
+	pattern := []byte("verification")
+	limit := mseMaxPad + len(pattern)
+
+	tests := []struct {
+		pad  int
+		want bool
+	}{
+		{0, true},
+		{1, true},
+		{mseMaxPad, true},
+		{mseMaxPad + 1, false},
+	}
+	for _, test := range tests {
+		pad := bytes.Repeat([]byte{0xaa}, test.pad)
+		r := bytes.NewReader(append(pad, append(pattern, "rest"...)...))
+		err := syncTo(r, pattern, limit)
+		if (err == nil) != test.want {
+			t.Errorf("pad %d: got %v", test.pad, err)
+			continue
+		}
+		// the stream is left right after the pattern
+		rest, _ := io.ReadAll(r)
+		if err == nil && string(rest) != "rest" {
+			t.Errorf("pad %d: left %q after the pattern", test.pad, rest)
+		}
+	}
+}
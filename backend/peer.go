@@ -4,14 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
 	"net"
-	"strings"
+	"sync/atomic"
 	"time"
-
-	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 type messageID uint8
@@ -41,6 +40,8 @@ type Message struct {
 	Payload []byte
 }
 
+// Peer is a peer we know of. Once connected, its protocol state belongs
+// to the connection's loop; other goroutines read it through snapshot.
 type Peer struct {
 	ClientChoked     bool     `json:"client_choked"`
 	PeerChoked       bool     `json:"peer_choked"`
@@ -49,6 +50,100 @@ type Peer struct {
 	Bitfield         Bitfield `json:"bitfield"`
 	IP               string   `bencode:"ip" json:"ip"`
 	Port             string   `bencode:"port" json:"port"`
+	// PeerID is the hex peer id the peer sent in its handshake
+	PeerID    string `json:"peerId"`
+	Client    string `json:"client"`
+	Direction string `json:"direction"`
+	Encrypted bool   `json:"encrypted"`
+	Source    string `json:"source"`
+	Transport string `json:"transport"`
+	// noUTP is set once the peer didn't answer over uTP
+	noUTP bool
+	piece *pieceWork
+	// fast is set when both sides support the Fast Extension
+	fast bool
+	// pieces the peer lets us request while choked, and the ones we allow it
+	allowedFast    map[int]bool
+	allowedFastOut map[int]bool
+	// pieces the peer suggested we download
+	suggested []int
+	// pieces that failed their hash check when downloaded from the peer
+	failed map[int]bool
+	// pieces the peer rejected our requests for since it last unchoked us
+	rejected map[int]bool
+	// utMetadata is the extended message id the peer takes ut_metadata
+	// messages with, 0 if it doesn't
+	utMetadata int
+	// state is the protocol state the loop last published, and
+	// bitfieldChanged tells it the bitfield needs copying again
+	state           atomic.Pointer[peerState]
+	bitfieldChanged bool
+	// block payload bytes exchanged with the peer
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// requests counts our block requests the peer hasn't answered yet
+	requests atomic.Int64
+	// rates are kept up to date by the stats aggregator
+	downloadMeter rateMeter
+	uploadMeter   rateMeter
+	downloadRate  atomic.Int64
+	uploadRate    atomic.Int64
+}
+
+// peerState is a copy of the protocol state of a connected peer. It's
+// never modified once published.
+type peerState struct {
+	ClientChoked     bool
+	PeerChoked       bool
+	ClientInterested bool
+	PeerInterested   bool
+	Bitfield         Bitfield
+}
+
+// snapshot returns the peer's protocol state as of its last message. Safe
+// to call from any goroutine.
+func (p *Peer) snapshot() peerState {
+	state := p.state.Load()
+	if state == nil {
+		return peerState{ClientChoked: true, PeerChoked: true}
+	}
+	return *state
+}
+
+// publishState makes the loop's changes to the peer visible to snapshot.
+// Only the connection's loop calls it.
+func (p *Peer) publishState() {
+	state := peerState{
+		ClientChoked:     p.ClientChoked,
+		PeerChoked:       p.PeerChoked,
+		ClientInterested: p.ClientInterested,
+		PeerInterested:   p.PeerInterested,
+	}
+	old := p.state.Load()
+	if old != nil && !p.bitfieldChanged {
+		state.Bitfield = old.Bitfield
+		if state.ClientChoked == old.ClientChoked && state.PeerChoked == old.PeerChoked &&
+			state.ClientInterested == old.ClientInterested && state.PeerInterested == old.PeerInterested {
+			return
+		}
+	} else {
+		state.Bitfield = append(Bitfield(nil), p.Bitfield...)
+		p.bitfieldChanged = false
+	}
+	p.state.Store(&state)
+}
+
+// BlockSize is the size of the blocks we request pieces in
+const BlockSize = 16384 // 16 KB
+
+// pieceWork holds the blocks of a piece while it's being downloaded
+type pieceWork struct {
+	index      int
+	buf        []byte
+	downloaded int
+	// pending holds the length of the blocks requested and not received
+	// yet, by offset
+	pending map[int]int
 }
 
 type Handshake struct {
@@ -56,6 +151,8 @@ type Handshake struct {
 	infoHash [20]byte
 	// 20-byte string used as a unique ID for the client. This is usually the same peer_id that is transmitted in tracker requests.
 	peerID [20]byte
+	// extension bits, we use the Fast Extension and Extension Protocol ones
+	reserved [8]byte
 }
 
 func Read(r io.Reader) (*Message, error) {
@@ -70,6 +167,9 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > maxMessageLength {
+		return nil, fmt.Errorf("message of %d bytes is too long", length)
+	}
 
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r, messageBuf)
@@ -125,6 +225,7 @@ func parseHandshake(buf []byte) (*Handshake, error) {
 	}
 
 	var hs Handshake
+	copy(hs.reserved[:], buf[20:28])
 	copy(hs.infoHash[:], buf[28:48])
 	copy(hs.peerID[:], buf[48:68])
 
@@ -145,6 +246,16 @@ func (bf Bitfield) HasPiece(index int) bool {
 	return bf[byteIndex]>>(7-offset)&1 != 0
 }
 
+// Any tells if at least one piece is set
+func (bf Bitfield) Any() bool {
+	for _, b := range bf {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // SetPiece sets a bit in the bitfield
 func (bf Bitfield) SetPiece(index int) {
 	byteIndex := index / 8
@@ -152,52 +263,223 @@ func (bf Bitfield) SetPiece(index int) {
 	bf[byteIndex] |= 1 << (7 - offset)
 }
 
-func ConnectToPeer(ctx context.Context, peer *Peer, infoHash, peerID [20]byte) {
-	var conn net.Conn
-	var err error
+// openPeerConn dials a peer and exchanges handshakes, encrypting the
+// connection as the policy asks
+func openPeerConn(ctx context.Context, peer *Peer, infoHash [20]byte) (net.Conn, *Handshake, error) {
+	provide := encryptionProvide(GetEncryptionPolicy())
+	if provide != 0 {
+		// peers that don't speak MSE usually just drop the connection
+		conn, hs, err := handshakePeer(ctx, peer, infoHash, provide)
+		if err == nil || provide&cryptoPlaintext == 0 || ctx.Err() != nil {
+			return conn, hs, err
+		}
+	}
+	return handshakePeer(ctx, peer, infoHash, 0)
+}
+
+// encryptionProvide returns the crypto_provide bits we offer when dialing
+// under policy, 0 when we dial in plaintext. A policy that offers
+// plaintext falls back to a plaintext connection if encryption fails.
+func encryptionProvide(policy string) uint32 {
+	switch policy {
+	case EncryptionPrefer:
+		return cryptoRC4 | cryptoPlaintext
+	case EncryptionRequire:
+		return cryptoRC4
+	default:
+		return 0
+	}
+}
 
+// handshakePeer connects to the peer, encrypting the connection unless
+// provide is 0
+func handshakePeer(ctx context.Context, peer *Peer, infoHash [20]byte, provide uint32) (net.Conn, *Handshake, error) {
 	// fmt.Println("Connecting to peer:", peer.String())
-	conn, err = net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	conn, err := dialPeer(ctx, peer)
 	if err != nil {
-		return
+		return nil, nil, err
 	}
+	defer closeOnDone(ctx, conn)()
 
 	hs := &Handshake{
 		infoHash: infoHash,
 		peerID:   peerID,
 	}
 
-	serial := hs.Serialize()
-	_, err = conn.Write(serial)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	var c net.Conn = conn
+	if provide != 0 {
+		// our handshake goes along with the encryption handshake
+		c, peer.Encrypted, err = mseInitiate(conn, infoHash, hs.Serialize(), provide)
+	} else {
+		_, err = conn.Write(hs.Serialize())
+	}
 	if err != nil {
-		fmt.Println(err)
-		return
+		conn.Close()
+		return nil, nil, err
 	}
 
-	buf := make([]byte, 68) // buffer for handshake response
-	n2, err := conn.Read(buf)
+	receivedHS, err := readHandshake(c)
 	if err != nil {
-		return
+		conn.Close()
+		return nil, nil, err
 	}
 
-	// Parse the handshake from the buffer
-	receivedHS, err := parseHandshake(buf[:n2])
+	// fmt.Println("PEER STRING", string(receivedHS.peerID[:]))
+	if !bytes.Equal(receivedHS.infoHash[:], infoHash[:]) {
+		conn.Close()
+		return nil, nil, fmt.Errorf("info hash mismatch")
+	}
+	conn.SetDeadline(time.Time{})
+	return c, receivedHS, nil
+}
+
+// dialPeer connects over uTP or TCP. uTP gets a head start of
+// utpHeadStart, then TCP races it and the first connection wins, so peers
+// without uTP don't wait out its timeout. Both dials give up when ctx is
+// done.
+func dialPeer(ctx context.Context, peer *Peer) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 3 * time.Second}
+	if !UTPEnabled || peer.noUTP {
+		peer.Transport = TransportTCP
+		return dialer.DialContext(ctx, "tcp", peer.String())
+	}
+
+	type dialed struct {
+		conn      net.Conn
+		transport string
+		err       error
+	}
+	dialCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialed, 2)
+	go func() {
+		conn, err := dialUTP(dialCtx, peer.String(), utpConnectTimeout)
+		results <- dialed{conn, TransportUTP, err}
+	}()
+
+	pending := 1
+	tcpStarted := false
+	startTCP := func() {
+		tcpStarted = true
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(dialCtx, "tcp", peer.String())
+			results <- dialed{conn, TransportTCP, err}
+		}()
+	}
+	headStart := time.NewTimer(utpHeadStart)
+	defer headStart.Stop()
+
+	var err error
+	for pending > 0 {
+		select {
+		case <-headStart.C:
+			if !tcpStarted {
+				startTCP()
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the other dial is cancelled, or closed if it got through
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				peer.Transport = r.transport
+				peer.noUTP = r.transport == TransportTCP
+				return r.conn, nil
+			}
+			if r.transport == TransportTCP || err == nil {
+				err = r.err
+			}
+			if !tcpStarted {
+				startTCP()
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	peer.noUTP = true
+	peer.Transport = TransportTCP
+	return nil, err
+}
+
+// closeOnDone closes conn when ctx is done, which unblocks its reads when
+// the torrent stops. The returned function ends the wait.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func readHandshake(conn net.Conn) (*Handshake, error) {
+	buf := make([]byte, 68)
+	_, err := io.ReadFull(conn, buf)
 	if err != nil {
+		return nil, err
+	}
+	return parseHandshake(buf)
+}
+
+// runPeer exchanges messages with a peer after the handshakes, until the
+// connection drops
+func runPeer(cl *Client, conn net.Conn, peer *Peer, receivedHS *Handshake) {
+	var err error
+
+	// trackers hand us our own address too
+	if receivedHS.peerID == peerID {
+		fmt.Println("Skipping connection to ourselves:", peer.String())
 		return
 	}
 
-	// fmt.Println("PEER STRING", string(receivedHS.peerID[:]))
-	if !bytes.Equal(receivedHS.infoHash[:], infoHash[:]) {
-		fmt.Println("info hash mismatch")
+	peer.fast = receivedHS.reserved[7]&fastExtensionBit != 0
+	peer.PeerID = hex.EncodeToString(receivedHS.peerID[:])
+	peer.Client = ClientName(receivedHS.peerID[:])
+	publish(Event{Type: EventPeerConnected, TorrentID: cl.Torrent.ID, Data: PeerEvent{Address: peer.String()}})
+	cl.AddPeer(peer)
+	defer cl.RemovePeer(peer)
+	defer publish(Event{Type: EventPeerDisconnected, TorrentID: cl.Torrent.ID, Data: PeerEvent{Address: peer.String()}})
+
+	pc := newPeerConn(newLimitedConn(conn, cl))
+	defer pc.Close()
+	// whatever we asked for and didn't get goes back to the picker
+	defer peer.abortPiece(cl)
+	conn = pc
+
+	// let the peer know what we can upload
+	err = sendHaves(conn, cl, peer)
+	if err != nil {
+		fmt.Println("Error sending bitfield message", err)
 		return
 	}
 
-	runtime.EventsEmit(ctx, "peer-connect", peer)
-	cl := GetClient()
-	if cl == nil {
-		panic("client not found")
+	if peer.fast {
+		err = sendAllowedFast(conn, cl, peer)
+		if err != nil {
+			fmt.Println("Error sending allowed fast messages", err)
+			return
+		}
+	}
+
+	if receivedHS.reserved[5]&extensionBit != 0 {
+		err = sendExtHandshake(conn, cl, peer)
+		if err != nil {
+			fmt.Println("Error sending extension handshake", err)
+			return
+		}
 	}
-	cl.AddPeer(peer)
 
 	err = peer.SendMessage(conn, MsgUnchoke, nil)
 	if err != nil {
@@ -213,67 +495,60 @@ func ConnectToPeer(ctx context.Context, peer *Peer, infoHash, peerID [20]byte) {
 	}
 	peer.ClientInterested = true
 
+	peer.publishState()
+
+	// the loop is the only goroutine touching the peer's state from here on
+	numPieces := cl.Torrent.bencodeTorrent.NumPieces()
 	for {
-		msg, err := Read(conn)
-		if err != nil {
-			runtime.EventsEmit(ctx, "peer-disconnect", peer)
-			if err == io.EOF {
+		var msg *Message
+		select {
+		case msg = <-pc.incoming:
+		case <-pc.Done():
+			if pc.Err() == io.EOF {
 				fmt.Println("Connection closed by peer:", peer.String())
 			} else {
-				fmt.Println("Error reading message:", err)
+				fmt.Println("Error on connection:", pc.Err())
 			}
 			return
 		}
 
-		if msg == nil {
-			fmt.Println("Received keep-alive message from:", peer.String())
-			continue
+		if !validMessage(msg, numPieces, peer.fast) {
+			fmt.Printf("Invalid message %d from %s, disconnecting\n", msg.ID, peer.String())
+			return
 		}
 
-		handleMessage(conn, msg, peer)
-	}
-}
+		handleMessage(pc, cl, msg, peer)
+		peer.publishState()
 
-func handleMessage(conn net.Conn, msg *Message, peer *Peer) {
-	cl := GetClient()
-	if cl == nil {
-		panic("client not found")
+		if isBanned(peer.IP) {
+			fmt.Println("Disconnecting banned peer", peer.String())
+			return
+		}
+		if ipFiltered(peer.IP) {
+			fmt.Println("Disconnecting peer blocked by the IP filter", peer.String())
+			return
+		}
 	}
+}
 
+func handleMessage(conn *peerConn, cl *Client, msg *Message, peer *Peer) {
 	switch msg.ID {
 	case MsgChoke:
 		peer.ClientChoked = true
+		// a choking peer discards our pending requests, fast peers reject
+		// them one by one instead
+		if !peer.fast {
+			peer.abortPiece(cl)
+		}
 		// fmt.Println("Choked by:", peer.String())
 	case MsgUnchoke:
 		peer.ClientChoked = false
+		// what it rejected while choking us may be served now
+		peer.rejected = nil
 
-		// Constants
-		const BlockSize = 16384 // 16 KB
-
-		// Send multiple requests for the first piece
-		pieceIndex := 0
-		pieceLength := client.Torrent.bencodeTorrent.Info.PieceLength
-		numBlocks := (pieceLength + BlockSize - 1) / BlockSize // Round up division
-
-		for blockIndex := 0; blockIndex < numBlocks; blockIndex++ {
-			begin := blockIndex * BlockSize
-			length := BlockSize
-			if begin+length > pieceLength {
-				length = pieceLength - begin // Last block might be smaller
-			}
-
-			fmt.Printf("Requesting piece %d, block %d, begin %d, length %d from %s\n",
-				pieceIndex, blockIndex, begin, length, peer.String())
-
-			err := peer.SendRequest(conn, pieceIndex, begin, length)
-			if err != nil {
-				fmt.Println("Error sending request", err)
-				// Don't panic, just log and continue
-				log.Println(err)
-				continue
-			}
-
-			fmt.Printf("Sent request for piece %d, block %d to: %s\n", pieceIndex, blockIndex, peer.String())
+		err := requestNextPiece(conn, peer, cl)
+		if err != nil {
+			fmt.Println("Error sending request", err)
 		}
 
 	case MsgInterested:
@@ -285,58 +560,128 @@ func handleMessage(conn net.Conn, msg *Message, peer *Peer) {
 		// fmt.Println("Peer not interested:", peer.String())
 	case MsgHave:
 		pieceIndex := binary.BigEndian.Uint32(msg.Payload)
+		if peer.Bitfield == nil {
+			peer.Bitfield = NewBitfield(make([]byte, len(cl.Bitfield)))
+		}
+		// a repeated have mustn't count twice
+		if peer.Bitfield.HasPiece(int(pieceIndex)) {
+			return
+		}
 		peer.Bitfield.SetPiece(int(pieceIndex))
+		peer.bitfieldChanged = true
+		cl.picker.IncrementAvailability(int(pieceIndex))
 		// fmt.Printf("Peer %s has piece %d\n", peer.String(), pieceIndex)
 		// You might want to express interest if you need this piece
 	case MsgBitfield:
-		bf := NewBitfield(msg.Payload)
-		peer.Bitfield = bf
-
-		for i := range bf {
-			if bf[i] == 1 {
-				client.Torrent.bencodeTorrent.havePieces[peer.Identifier()] |= 1 << uint(i)
-			}
+		setPeerBitfield(conn, cl, peer, NewBitfield(msg.Payload))
+	case MsgHaveAll:
+		setPeerBitfield(conn, cl, peer, fullBitfield(cl.Torrent.bencodeTorrent.NumPieces()))
+	case MsgHaveNone:
+		setPeerBitfield(conn, cl, peer, NewBitfield(make([]byte, len(cl.Bitfield))))
+	case MsgSuggest:
+		index := int(binary.BigEndian.Uint32(msg.Payload))
+		if len(peer.suggested) < maxSuggestions {
+			peer.suggested = append(peer.suggested, index)
+		}
+	case MsgAllowedFast:
+		index := int(binary.BigEndian.Uint32(msg.Payload))
+		if peer.allowedFast == nil {
+			peer.allowedFast = make(map[int]bool)
 		}
+		peer.allowedFast[index] = true
 
-		for i := 0; i < client.Torrent.bencodeTorrent.NumPieces(); i++ {
-			if peer.Bitfield.HasPiece(i) && !client.Bitfield.HasPiece(i) {
-				// This peer has a piece we need
+		err := requestNextPiece(conn, peer, cl)
+		if err != nil {
+			fmt.Println("Error sending request", err)
+		}
+	case MsgReject:
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+		work := peer.piece
+		if work == nil || work.index != index || work.pending[begin] != length || length == 0 {
+			return
+		}
+		// we only request whole pieces, so the rest of it goes back too, and
+		// the other blocks' rejects match nothing anymore
+		peer.abortPiece(cl)
+		if peer.rejected == nil {
+			peer.rejected = make(map[int]bool)
+		}
+		peer.rejected[index] = true
 
-				// send interested message
-				if !peer.ClientInterested {
-					err := peer.SendMessage(conn, MsgInterested, nil)
-					if err != nil {
-						fmt.Println("Error sending interested message", err)
-						return
-					}
-					peer.ClientInterested = true
-					return
-				}
-				break
-			}
+		err := requestNextPiece(conn, peer, cl)
+		if err != nil {
+			fmt.Println("Error sending request", err)
 		}
 	case MsgRequest:
 		index := binary.BigEndian.Uint32(msg.Payload[0:4])
 		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
 		length := binary.BigEndian.Uint32(msg.Payload[8:12])
 		fmt.Printf("Peer %s requested piece %d, begin %d, length %d\n", peer.String(), index, begin, length)
-		// Handle the request: check if you have the piece and send it if you do
+
+		err := uploadBlock(conn, cl, peer, int(index), int64(begin), int64(length))
+		if err != nil {
+			fmt.Println("Error uploading block", err)
+		}
 	case MsgPiece:
 		index := binary.BigEndian.Uint32(msg.Payload[0:4])
 		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
 		data := msg.Payload[8:]
 
+		work := peer.piece
+		if work == nil || work.index != int(index) || work.pending[int(begin)] != len(data) || len(data) == 0 {
+			fmt.Printf("Unexpected block for piece %d, begin %d from %s\n", index, begin, peer.String())
+			return
+		}
+
+		delete(work.pending, int(begin))
+		copy(work.buf[begin:], data)
+		work.downloaded += len(data)
+		peer.requests.Add(-1)
+		peer.downloaded.Add(int64(len(data)))
+		atomic.AddInt64(&cl.Torrent.Downloaded, int64(len(data)))
+		if work.downloaded < len(work.buf) {
+			return
+		}
+		peer.piece = nil
+
 		// check if the piece is valid
-		if !client.Torrent.bencodeTorrent.VerifyPiece(index, data) {
-			err := conn.Close()
+		if !cl.Torrent.bencodeTorrent.VerifyPiece(index, work.buf) {
+			cl.picker.Abort(int(index))
+			cl.wasted.Add(int64(len(work.buf)))
+			fmt.Printf("Piece %d from %s failed its hash check\n", index, peer.String())
+			if peer.failed == nil {
+				peer.failed = make(map[int]bool)
+			}
+			peer.failed[int(index)] = true
+			if recordHashFailure(peer) {
+				conn.Close()
+				return
+			}
+
+			err := requestNextPiece(conn, peer, cl)
 			if err != nil {
-				panic(err)
+				fmt.Println("Error sending request", err)
 			}
-			fmt.Println("Invalid piece")
 			return
 		}
 
-		fmt.Printf("Received piece %d, begin %d, length %d from %s\n", index, begin, len(data), peer.String())
+		err := cl.storePiece(int(index), work.buf)
+		if err != nil {
+			fmt.Println("Error writing piece", err)
+			return
+		}
+
+		fmt.Printf("Received piece %d, length %d from %s\n", index, len(work.buf), peer.String())
+
+		err = requestNextPiece(conn, peer, cl)
+		if err != nil {
+			fmt.Println("Error sending request", err)
+		}
+
+	case MsgExtended:
+		handleExtended(conn, cl, msg.Payload, peer)
 
 	case MsgCancel:
 		index := binary.BigEndian.Uint32(msg.Payload[0:4])
@@ -347,6 +692,132 @@ func handleMessage(conn net.Conn, msg *Message, peer *Peer) {
 	}
 }
 
+// setPeerBitfield records the pieces a peer has and tells it whether we're
+// interested. The bitfield replaces whatever haves or bitfield came before.
+func setPeerBitfield(conn net.Conn, cl *Client, peer *Peer, bf Bitfield) {
+	if peer.Bitfield != nil {
+		cl.picker.RemoveAvailability(peer.Bitfield)
+	}
+	peer.Bitfield = bf
+	peer.bitfieldChanged = true
+	cl.picker.AddAvailability(bf)
+
+	// other peers' loops store pieces meanwhile
+	cl.mutex.Lock()
+	have := append(Bitfield(nil), cl.Bitfield...)
+	cl.mutex.Unlock()
+
+	for i := 0; i < cl.Torrent.bencodeTorrent.NumPieces(); i++ {
+		if peer.Bitfield.HasPiece(i) && !have.HasPiece(i) {
+			// This peer has a piece we need
+
+			// send interested message
+			if !peer.ClientInterested {
+				err := peer.SendMessage(conn, MsgInterested, nil)
+				if err != nil {
+					fmt.Println("Error sending interested message", err)
+					return
+				}
+				peer.ClientInterested = true
+				return
+			}
+			break
+		}
+	}
+}
+
+// requestNextPiece asks the peer for every block of the next piece the picker chooses
+func requestNextPiece(conn net.Conn, peer *Peer, cl *Client) error {
+	if peer.piece != nil || peer.Bitfield == nil {
+		return nil
+	}
+	if peer.ClientChoked && len(peer.allowedFast) == 0 {
+		return nil
+	}
+
+	cl.mutex.Lock()
+	index, ok := pickPiece(cl, peer)
+	cl.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	start, end := cl.Torrent.pieceSpan(index)
+	length := int(end - start)
+	peer.piece = &pieceWork{
+		index:   index,
+		buf:     make([]byte, length),
+		pending: make(map[int]int),
+	}
+
+	for begin := 0; begin < length; begin += BlockSize {
+		blockLength := min(BlockSize, length-begin)
+		err := peer.SendRequest(conn, index, begin, blockLength)
+		if err != nil {
+			peer.abortPiece(cl)
+			return err
+		}
+		peer.piece.pending[begin] = blockLength
+		peer.requests.Add(1)
+	}
+	return nil
+}
+
+// maxRequestLength is the largest block we serve, as in most clients
+const maxRequestLength = 128 * 1024
+
+// uploadBlock answers a request for a block of a piece we have. Requests we
+// can't serve, or that would overfill the outbound queue, are rejected, or
+// ignored by peers without the Fast Extension.
+func uploadBlock(conn *peerConn, cl *Client, peer *Peer, index int, begin, length int64) error {
+	if peer.PeerChoked && !peer.allowedFastOut[index] {
+		return rejectRequest(conn, peer, index, begin, length)
+	}
+	if length <= 0 || length > maxRequestLength || conn.Queued() >= maxQueuedBytes {
+		return rejectRequest(conn, peer, index, begin, length)
+	}
+
+	cl.mutex.Lock()
+	have := index < cl.Torrent.bencodeTorrent.NumPieces() && cl.Bitfield.HasPiece(index)
+	cl.mutex.Unlock()
+	if !have {
+		return rejectRequest(conn, peer, index, begin, length)
+	}
+
+	start, end := cl.Torrent.pieceSpan(index)
+	if begin < 0 || start+begin+length > end {
+		return rejectRequest(conn, peer, index, begin, length)
+	}
+
+	payload := make([]byte, 8+length)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	_, err := cl.storage.ReadAt(payload[8:], start+begin)
+	if err != nil {
+		return err
+	}
+
+	err = peer.SendMessage(conn, MsgPiece, payload)
+	if err != nil {
+		return err
+	}
+
+	peer.uploaded.Add(length)
+	atomic.AddInt64(&cl.Torrent.Uploaded, length)
+	cl.lastUpload.Store(time.Now().Unix())
+	return nil
+}
+
+// abortPiece gives the piece being downloaded from this peer back to the picker
+func (p *Peer) abortPiece(cl *Client) {
+	if p.piece == nil {
+		return
+	}
+	cl.picker.Abort(p.piece.index)
+	p.piece = nil
+	p.requests.Store(0)
+}
+
 func (p *Peer) SendRequest(c net.Conn, index, begin, length int) error {
 	payload := make([]byte, 12)
 	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
@@ -387,15 +858,25 @@ func (h *Handshake) Serialize() []byte {
 	buf := make([]byte, 68)
 	buf[0] = 19
 	copy(buf[1:20], "BitTorrent protocol")
+	buf[25] |= extensionBit
+	buf[27] |= fastExtensionBit
 	copy(buf[28:48], h.infoHash[:])
 	copy(buf[48:68], h.peerID[:])
 	return buf
 }
 
 func (p *Peer) String() string {
-	return strings.Join([]string{p.IP, p.Port}, ":")
+	return net.JoinHostPort(p.IP, p.Port)
 }
 
+// Identifier is a number derived from the peer's IP
 func (p *Peer) Identifier() int {
-	return int(binary.BigEndian.Uint32(net.ParseIP(p.IP).To4()))
+	ip := net.ParseIP(p.IP)
+	if ip4 := ip.To4(); ip4 != nil {
+		return int(binary.BigEndian.Uint32(ip4))
+	}
+
+	h := fnv.New64a()
+	h.Write(ip.To16())
+	return int(h.Sum64())
 }
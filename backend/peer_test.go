@@ -0,0 +1,315 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPeerStateRace downloads a torrent from two peers while other
+// goroutines read the torrent, its peers and its stats the way the GUI and
+// the RPC servers do. It's meant for go test -race.
+func TestPeerStateRace(t *testing.T) {
+	newTestSession(t)
+
+	const pieceLength = 32 << 10
+	src := filepath.Join(t.TempDir(), "race.bin")
+	data := writeTestFile(t, src, 32*pieceLength+1000)
+	torrent := addTestTorrent(t, src, pieceLength)
+	cl := Enqueue(torrent)
+
+	// more peers join while the first one's loop stores pieces
+	var remotes []net.Conn
+	var peers sync.WaitGroup
+	startPeer := func(id byte, ip string) {
+		local, remote := net.Pipe()
+		remotes = append(remotes, remote)
+		go serveTestSeed(remote, data, pieceLength)
+
+		peers.Add(1)
+		go func() {
+			defer peers.Done()
+			hs := &Handshake{infoHash: torrent.bencodeTorrent.Info.hash(), peerID: [20]byte{'-', 'T', 'T', id}}
+			runPeer(cl, local, &Peer{IP: ip, Port: "6881"}, hs)
+		}()
+	}
+	defer func() {
+		for _, remote := range remotes {
+			remote.Close()
+		}
+		peers.Wait()
+	}()
+
+	startPeer(1, "127.0.0.1")
+	deadline := time.Now().Add(10 * time.Second)
+	for i := byte(2); i <= 4; i++ {
+		for cl.Completed() < int64(i-1)*4*pieceLength && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		startPeer(i, fmt.Sprintf("127.0.0.%d", i))
+	}
+
+	trFields := `["status", "rateDownload", "eta", "files", "priorities", "queuePosition", "sequentialDownload"]`
+	readers := []func(){
+		func() { GetPeers(torrent.ID) },
+		func() { json.Marshal(torrent.Snapshot()) },
+		func() { GetTorrents() },
+		func() { SetFilePriority(torrent.ID, 0, PriorityHigh) },
+		func() { SetSequential(torrent.ID, true) },
+		func() { updateStats(time.Second) },
+		func() { checkSeedingGoals(time.Second) },
+		func() { transmissionGet(map[string]json.RawMessage{"fields": json.RawMessage(trFields)}) },
+		func() { qbTorrentInfo(cl) },
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, read := range readers {
+		wg.Add(1)
+		go func(read func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					read()
+				}
+			}
+		}(read)
+	}
+
+	complete := waitComplete(cl, 10*time.Second)
+	close(stop)
+	wg.Wait()
+
+	if !complete {
+		t.Fatal("download didn't complete")
+	}
+	got, err := os.ReadFile(filepath.Join(DownloadDir, "race.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs from the seed's")
+	}
+}
+
+// TestHashFailureBan bans a peer once it sent banThreshold pieces that
+// fail their hash check
+func TestHashFailureBan(t *testing.T) {
+	newTestSession(t)
+
+	const pieceLength = 16 << 10
+	src := filepath.Join(t.TempDir(), "corrupt.bin")
+	data := writeTestFile(t, src, 8*pieceLength)
+	torrent := addTestTorrent(t, src, pieceLength)
+	cl := NewClient(torrent)
+
+	corrupt := append([]byte(nil), data...)
+	for i := 0; i < len(corrupt); i += pieceLength {
+		corrupt[i+100] ^= 0xff
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go serveTestSeed(remote, corrupt, pieceLength)
+
+	peer := &Peer{IP: "192.0.2.46", Port: "6881"}
+	t.Cleanup(func() {
+		poolMutex.Lock()
+		delete(bannedIPs, peer.IP)
+		delete(hashFailures, peer.IP)
+		poolMutex.Unlock()
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hs := &Handshake{infoHash: torrent.bencodeTorrent.Info.hash(), peerID: [20]byte{'-', 'T', 'T'}}
+		runPeer(cl, local, peer, hs)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("peer sending corrupt pieces wasn't disconnected")
+	}
+	if !isBanned(peer.IP) {
+		t.Error("peer sending corrupt pieces wasn't banned")
+	}
+	poolMutex.Lock()
+	failures := hashFailures[peer.IP]
+	poolMutex.Unlock()
+	if failures != banThreshold {
+		t.Errorf("peer was banned after %d failed pieces, want %d", failures, banThreshold)
+	}
+	if cl.Completed() != 0 {
+		t.Error("corrupt pieces were stored")
+	}
+}
+
+// TestSetPeerBitfieldRace stores pieces while a peer's bitfield arrives,
+// which compares it with ours. It's meant for go test -race.
+func TestSetPeerBitfieldRace(t *testing.T) {
+	newTestSession(t)
+
+	const pieceLength = 16 << 10
+	src := filepath.Join(t.TempDir(), "bitfield.bin")
+	data := writeTestFile(t, src, 64*pieceLength)
+	torrent := addTestTorrent(t, src, pieceLength)
+	cl := NewClient(torrent)
+	numPieces := torrent.bencodeTorrent.NumPieces()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < numPieces; i++ {
+			start, end := torrent.pieceSpan(i)
+			cl.storePiece(i, data[start:end])
+		}
+	}()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	go io.Copy(io.Discard, remote)
+	peer := &Peer{IP: "127.0.0.1", Port: "6881", ClientInterested: true}
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			setPeerBitfield(local, cl, peer, fullBitfield(numPieces))
+		}
+	}
+}
+
+// TestRejectedPieces has a fast peer choke us and reject every request for
+// its allowed fast pieces. Each piece should be asked for once.
+func TestRejectedPieces(t *testing.T) {
+	newTestSession(t)
+
+	const pieceLength = 32 << 10
+	src := filepath.Join(t.TempDir(), "rejected.bin")
+	writeTestFile(t, src, 8*pieceLength)
+	torrent := addTestTorrent(t, src, pieceLength)
+	cl := NewClient(torrent)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	requests := make(chan int, 100)
+	go func() {
+		defer close(requests)
+		messages := []*Message{{ID: MsgHaveAll}}
+		for _, index := range []uint32{2, 5} {
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, index)
+			messages = append(messages, &Message{ID: MsgAllowedFast, Payload: payload})
+		}
+		for _, msg := range messages {
+			_, err := remote.Write(msg.Serialize())
+			if err != nil {
+				return
+			}
+		}
+		for {
+			msg, err := Read(remote)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != MsgRequest {
+				continue
+			}
+			requests <- int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+			reject := Message{ID: MsgReject, Payload: msg.Payload}
+			_, err = remote.Write(reject.Serialize())
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hs := &Handshake{infoHash: torrent.bencodeTorrent.Info.hash(), peerID: [20]byte{'-', 'T', 'T'}}
+		hs.reserved[7] = fastExtensionBit
+		runPeer(cl, local, &Peer{IP: "127.0.0.1", Port: "6881", ClientChoked: true, PeerChoked: true}, hs)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	remote.Close()
+	<-done
+
+	counts := make(map[int]int)
+	for index := range requests {
+		counts[index]++
+	}
+	// a piece is two blocks
+	if len(counts) != 2 || counts[2] != 2 || counts[5] != 2 {
+		t.Errorf("got requests %v, want two blocks of pieces 2 and 5", counts)
+	}
+}
+
+// TestPeerAvailability sends haves, then bitfields replacing them, and
+// checks the picker forgets all of it when the peer leaves
+func TestPeerAvailability(t *testing.T) {
+	newTestSession(t)
+
+	const pieceLength = 16 << 10
+	src := filepath.Join(t.TempDir(), "availability.bin")
+	writeTestFile(t, src, 10*pieceLength)
+	torrent := addTestTorrent(t, src, pieceLength)
+	cl := NewClient(torrent)
+	numPieces := torrent.bencodeTorrent.NumPieces()
+
+	have := func(index uint32) *Message {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, index)
+		return &Message{ID: MsgHave, Payload: payload}
+	}
+	bitfield := make(Bitfield, (numPieces+7)/8)
+	bitfield.SetPiece(1)
+	bitfield.SetPiece(2)
+	messages := []*Message{have(1), have(3), have(3), {ID: MsgBitfield, Payload: bitfield}, {ID: MsgHaveAll}, have(4)}
+
+	local, remote := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hs := &Handshake{infoHash: torrent.bencodeTorrent.Info.hash(), peerID: [20]byte{'-', 'T', 'T'}}
+		hs.reserved[7] = fastExtensionBit
+		runPeer(cl, local, &Peer{IP: "127.0.0.1", Port: "6881", ClientChoked: true, PeerChoked: true}, hs)
+	}()
+	go io.Copy(io.Discard, remote)
+	for _, msg := range messages {
+		_, err := remote.Write(msg.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the peer has every piece once, whatever it sent
+	deadline := time.Now().Add(5 * time.Second)
+	for cl.picker.PieceAvailability(0) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < numPieces; i++ {
+		if n := cl.picker.PieceAvailability(i); n != 1 {
+			t.Errorf("piece %d has availability %d while connected, want 1", i, n)
+		}
+	}
+
+	remote.Close()
+	<-done
+	for i := 0; i < numPieces; i++ {
+		if n := cl.picker.PieceAvailability(i); n != 0 {
+			t.Errorf("piece %d has availability %d after the peer left, want 0", i, n)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// peerIDPrefix is the Azureus-style prefix of our peer id, gorrent 0.1.0
+const peerIDPrefix = "-GR0100-"
+
+// peerID identifies this session in handshakes and announces. It's new on
+// every start so peers and trackers can't track users across sessions.
+var peerID = newPeerID()
+
+func newPeerID() [20]byte {
+	var id [20]byte
+	copy(id[:], peerIDPrefix)
+	_, err := rand.Read(id[len(peerIDPrefix):])
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// newAnnounceKey returns a random key sent with announces, which lets
+// trackers recognize us when our IP changes
+func newAnnounceKey() string {
+	key := make([]byte, 4)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return strings.ToUpper(hex.EncodeToString(key))
+}
+
+// azureusClients are the two letter codes of Azureus-style peer ids, -XX1234-
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FW": "FrostWire",
+	"FX": "Freebox",
+	"GR": "gorrent",
+	"HL": "Halite",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"LW": "LimeWire",
+	"PI": "PicoTorrent",
+	"RT": "Retriever",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"TX": "Tixati",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+}
+
+// shadowClients are the first letter of Shadow-style peer ids, A123----
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT BitTorrent",
+}
+
+// ClientName decodes the client and version from a peer id. Unknown ids
+// give "Unknown" followed by their printable prefix.
+func ClientName(peerID []byte) string {
+	if len(peerID) != 20 {
+		return "Unknown"
+	}
+
+	if name, ok := azureusName(peerID); ok {
+		return name
+	}
+	if name, ok := mainlineName(peerID); ok {
+		return name
+	}
+	if name, ok := shadowName(peerID); ok {
+		return name
+	}
+
+	prefix := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, string(peerID[:8]))
+	return strings.TrimSpace("Unknown " + prefix)
+}
+
+func azureusName(id []byte) (string, bool) {
+	if id[0] != '-' || id[7] != '-' {
+		return "", false
+	}
+
+	client, ok := azureusClients[string(id[1:3])]
+	if !ok {
+		return "", false
+	}
+
+	v := id[3:7]
+	for _, c := range v {
+		if versionDigit(c) < 0 {
+			return "", false
+		}
+	}
+
+	var version string
+	switch {
+	case string(id[1:3]) == "TR" && v[0] <= '2':
+		// Transmission 0.x to 2.x use two digit minors, -TR2940- is 2.94
+		version = fmt.Sprintf("%d.%c%c", versionDigit(v[0]), v[1], v[2])
+	default:
+		version = fmt.Sprintf("%d.%d.%d", versionDigit(v[0]), versionDigit(v[1]), versionDigit(v[2]))
+		if v[3] >= '1' && v[3] <= '9' {
+			version += fmt.Sprintf(".%d", versionDigit(v[3]))
+		}
+	}
+	return client + " " + version, true
+}
+
+// mainlineName decodes the old BitTorrent ids, M4-3-6--
+func mainlineName(id []byte) (string, bool) {
+	if id[0] != 'M' {
+		return "", false
+	}
+
+	end := strings.Index(string(id[1:]), "--")
+	if end < 0 {
+		return "", false
+	}
+
+	parts := strings.Split(string(id[1:1+end]), "-")
+	for _, p := range parts {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return "", false
+		}
+	}
+	return "BitTorrent " + strings.Join(parts, "."), true
+}
+
+func shadowName(id []byte) (string, bool) {
+	client, ok := shadowClients[id[0]]
+	if !ok {
+		return "", false
+	}
+
+	var parts []string
+	for _, c := range id[1:6] {
+		if c == '-' {
+			break
+		}
+		d := shadowDigit(c)
+		if d < 0 {
+			return "", false
+		}
+		parts = append(parts, fmt.Sprint(d))
+	}
+	if len(parts) == 0 || !strings.Contains(string(id[1:9]), "--") {
+		return "", false
+	}
+	return client + " " + strings.Join(parts, "."), true
+}
+
+// versionDigit decodes 0-9 and A-Z as 0 to 35
+func versionDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	default:
+		return -1
+	}
+}
+
+// shadowDigit decodes 0-9, A-Z, a-z and '.' as 0 to 62
+func shadowDigit(c byte) int {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36
+	case c == '.':
+		return 62
+	default:
+		return versionDigit(c)
+	}
+}
@@ -0,0 +1,95 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	PeerOutgoing = "outgoing"
+	PeerIncoming = "incoming"
+
+	// PeerSourceTracker marks peers we got from a tracker announce
+	PeerSourceTracker = "tracker"
+	// PeerSourceIncoming marks peers that connected to us
+	PeerSourceIncoming = "incoming"
+	// PeerSourceMagnet marks peers listed in a magnet link (x.pe)
+	PeerSourceMagnet = "magnet"
+
+	TransportTCP = "tcp"
+	TransportUTP = "utp"
+)
+
+// PeerInfo is a snapshot of a connected peer for the peers view. Rates are
+// in bytes per second and progress in percent.
+type PeerInfo struct {
+	Address             string  `json:"address"`
+	PeerID              string  `json:"peerId"`
+	Client              string  `json:"client"`
+	Progress            float64 `json:"progress"`
+	DownloadRate        int64   `json:"downloadRate"`
+	UploadRate          int64   `json:"uploadRate"`
+	Downloaded          int64   `json:"downloaded"`
+	Uploaded            int64   `json:"uploaded"`
+	OutstandingRequests int     `json:"outstandingRequests"`
+	Direction           string  `json:"direction"`
+	Encrypted           bool    `json:"encrypted"`
+	Source              string  `json:"source"`
+	Transport           string  `json:"transport"`
+	ClientChoked        bool    `json:"clientChoked"`
+	PeerChoked          bool    `json:"peerChoked"`
+	ClientInterested    bool    `json:"clientInterested"`
+	PeerInterested      bool    `json:"peerInterested"`
+}
+
+// GetPeers returns the peers a torrent is connected to
+func GetPeers(torrentID int) ([]PeerInfo, error) {
+	cl := GetClient(torrentID)
+	if cl == nil {
+		return nil, fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	numPieces := cl.Torrent.bencodeTorrent.NumPieces()
+	peers := make([]PeerInfo, 0, len(cl.Peers))
+	for _, p := range cl.Peers {
+		state := p.snapshot()
+		info := PeerInfo{
+			Address:             p.String(),
+			PeerID:              p.PeerID,
+			Client:              p.Client,
+			DownloadRate:        p.downloadRate.Load(),
+			UploadRate:          p.uploadRate.Load(),
+			Downloaded:          p.downloaded.Load(),
+			Uploaded:            p.uploaded.Load(),
+			OutstandingRequests: int(p.requests.Load()),
+			Direction:           p.Direction,
+			Encrypted:           p.Encrypted,
+			Source:              p.Source,
+			Transport:           p.Transport,
+			ClientChoked:        state.ClientChoked,
+			PeerChoked:          state.PeerChoked,
+			ClientInterested:    state.ClientInterested,
+			PeerInterested:      state.PeerInterested,
+		}
+		if state.Bitfield != nil && numPieces > 0 {
+			info.Progress = float64(countPieces(state.Bitfield, numPieces)) / float64(numPieces) * 100
+		}
+		peers = append(peers, info)
+	}
+	return peers, nil
+}
+
+// updatePeerRates refreshes the transfer rates of the connected peers.
+// Only the stats aggregator calls it.
+func (c *Client) updatePeerRates(elapsed time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, p := range c.Peers {
+		p.downloadRate.Store(p.downloadMeter.update(p.downloaded.Load(), elapsed))
+		p.uploadRate.Store(p.uploadMeter.update(p.uploaded.Load(), elapsed))
+	}
+}
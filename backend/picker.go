@@ -0,0 +1,225 @@
+package backend
+
+import (
+	"sync"
+)
+
+// readaheadPieces is how many pieces past a read position are fetched first
+const readaheadPieces = 8
+
+// PiecePicker decides which piece to request next. Pieces right ahead of an
+// open reader come first, then pieces of higher priority files, and among
+// those the rarest ones in the swarm or, in sequential mode, the earliest.
+type PiecePicker struct {
+	priorities   []FilePriority
+	availability []int
+	inProgress   map[int]bool
+	sequential   bool
+	// piece each open reader is currently at, by reader id
+	readPositions map[int]int
+	mutex         sync.Mutex
+}
+
+func NewPiecePicker(t *Torrent) *PiecePicker {
+	numPieces := t.bencodeTorrent.NumPieces()
+	pp := &PiecePicker{
+		priorities:    make([]FilePriority, numPieces),
+		availability:  make([]int, numPieces),
+		inProgress:    make(map[int]bool),
+		sequential:    t.Snapshot().Sequential,
+		readPositions: make(map[int]int),
+	}
+	pp.UpdatePriorities(t)
+	return pp
+}
+
+// UpdatePriorities recomputes piece priorities from the torrent's file priorities
+func (pp *PiecePicker) UpdatePriorities(t *Torrent) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	for i := range pp.priorities {
+		pp.priorities[i] = t.piecePriority(i)
+	}
+}
+
+// AddAvailability counts the pieces of a peer's bitfield
+func (pp *PiecePicker) AddAvailability(bf Bitfield) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	for i := range pp.availability {
+		if i/8 < len(bf) && bf.HasPiece(i) {
+			pp.availability[i]++
+		}
+	}
+}
+
+// Availability is the number of distributed copies among connected peers:
+// how many full copies exist, plus the fraction of pieces above that count
+func (pp *PiecePicker) Availability() float64 {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if len(pp.availability) == 0 {
+		return 0
+	}
+
+	least := pp.availability[0]
+	for _, a := range pp.availability {
+		least = min(least, a)
+	}
+
+	above := 0
+	for _, a := range pp.availability {
+		if a > least {
+			above++
+		}
+	}
+	return float64(least) + float64(above)/float64(len(pp.availability))
+}
+
+// RemoveAvailability uncounts the pieces of a peer that left
+func (pp *PiecePicker) RemoveAvailability(bf Bitfield) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	for i := range pp.availability {
+		if i/8 < len(bf) && bf.HasPiece(i) && pp.availability[i] > 0 {
+			pp.availability[i]--
+		}
+	}
+}
+
+// PieceAvailability is how many connected peers have a piece
+func (pp *PiecePicker) PieceAvailability(index int) int {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if index < 0 || index >= len(pp.availability) {
+		return 0
+	}
+	return pp.availability[index]
+}
+
+// IncrementAvailability counts a single piece announced with a have message
+func (pp *PiecePicker) IncrementAvailability(index int) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if index >= 0 && index < len(pp.availability) {
+		pp.availability[index]++
+	}
+}
+
+func (pp *PiecePicker) SetSequential(sequential bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	pp.sequential = sequential
+}
+
+// SetReadPosition moves the readahead window of a reader to the given piece
+func (pp *PiecePicker) SetReadPosition(reader, index int) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	pp.readPositions[reader] = index
+}
+
+func (pp *PiecePicker) RemoveReader(reader int) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	delete(pp.readPositions, reader)
+}
+
+// Pick returns the best piece the peer has that we still need and marks it in progress
+func (pp *PiecePicker) Pick(peer, have Bitfield) (int, bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	available := func(i int) bool {
+		return !pp.inProgress[i] && !have.HasPiece(i) && i/8 < len(peer) && peer.HasPiece(i)
+	}
+
+	// the piece closest ahead of any reader wins, even in skipped files,
+	// since someone is waiting on it
+	best, bestDistance := -1, 0
+	for _, position := range pp.readPositions {
+		end := min(position+readaheadPieces, len(pp.priorities))
+		for i := position; i < end; i++ {
+			if !available(i) {
+				continue
+			}
+			if best == -1 || i-position < bestDistance {
+				best, bestDistance = i, i-position
+			}
+			break
+		}
+	}
+
+	if best == -1 {
+		for i, priority := range pp.priorities {
+			if priority == PrioritySkip || !available(i) {
+				continue
+			}
+
+			if best == -1 || priority > pp.priorities[best] {
+				best = i
+				continue
+			}
+			if !pp.sequential && priority == pp.priorities[best] && pp.availability[i] < pp.availability[best] {
+				best = i
+			}
+		}
+	}
+
+	if best == -1 {
+		return 0, false
+	}
+	pp.inProgress[best] = true
+	return best, true
+}
+
+// PickFrom returns the first of the given pieces the peer has and we still
+// want, and marks it in progress. It serves suggested and allowed fast pieces.
+func (pp *PiecePicker) PickFrom(candidates []int, peer, have Bitfield) (int, bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	for _, i := range candidates {
+		if i < 0 || i >= len(pp.priorities) || pp.priorities[i] == PrioritySkip {
+			continue
+		}
+		if pp.inProgress[i] || have.HasPiece(i) || i/8 >= len(peer) || !peer.HasPiece(i) {
+			continue
+		}
+		pp.inProgress[i] = true
+		return i, true
+	}
+	return 0, false
+}
+
+// Remaining counts the wanted pieces we don't have yet
+func (pp *PiecePicker) Remaining(have Bitfield) int {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	remaining := 0
+	for i, priority := range pp.priorities {
+		if priority != PrioritySkip && !have.HasPiece(i) {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// Abort puts a piece back so it can be picked again
+func (pp *PiecePicker) Abort(index int) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	delete(pp.inProgress, index)
+}
+
+// Done marks a piece as no longer in progress once it's verified and stored
+func (pp *PiecePicker) Done(index int) {
+	pp.Abort(index)
+}
@@ -0,0 +1,260 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionSettings caps peer connections, 0 meaning no cap. Half-open
+// connections are outgoing ones still dialing or handshaking.
+type ConnectionSettings struct {
+	MaxConnections           int `json:"maxConnections"`
+	MaxConnectionsPerTorrent int `json:"maxConnectionsPerTorrent"`
+	MaxHalfOpen              int `json:"maxHalfOpen"`
+}
+
+const (
+	// poolInterval is how often each torrent looks for peers to connect to
+	poolInterval = time.Second
+	// failed peers are retried after retryBackoff, doubling up to
+	// maxRetryBackoff, and forgotten after maxConnectFailures
+	retryBackoff       = 15 * time.Second
+	maxRetryBackoff    = 30 * time.Minute
+	maxConnectFailures = 8
+	// reconnectDelay is how long we wait before dialing a peer that
+	// dropped a working connection
+	reconnectDelay = time.Minute
+	// banThreshold is how many failed pieces a peer may send before it's banned
+	banThreshold = 3
+)
+
+var (
+	connectionSettings = ConnectionSettings{MaxConnections: 200, MaxConnectionsPerTorrent: 50, MaxHalfOpen: 20}
+	openConnections    int
+	halfOpen           int
+	// hashFailures counts the failed pieces each IP contributed to
+	hashFailures = make(map[string]int)
+	bannedIPs    = make(map[string]bool)
+	poolMutex    sync.Mutex
+)
+
+// candidate is a peer address a torrent may connect to
+type candidate struct {
+	ip         string
+	port       string
+	source     string
+	noUTP      bool
+	failures   int
+	retryAt    time.Time
+	connecting bool
+}
+
+func GetConnectionSettings() ConnectionSettings {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+	return connectionSettings
+}
+
+func SetConnectionSettings(s ConnectionSettings) error {
+	if s.MaxConnections < 0 || s.MaxConnectionsPerTorrent < 0 || s.MaxHalfOpen < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+
+	poolMutex.Lock()
+	connectionSettings = s
+	poolMutex.Unlock()
+	return nil
+}
+
+// reserveConnection takes a connection slot of the torrent, and a half-open
+// one for outgoing connections, if the limits allow it
+func reserveConnection(cl *Client, outgoing bool) bool {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	s := connectionSettings
+	if s.MaxConnections > 0 && openConnections >= s.MaxConnections {
+		return false
+	}
+	if s.MaxConnectionsPerTorrent > 0 && cl.connections >= s.MaxConnectionsPerTorrent {
+		return false
+	}
+	if outgoing && s.MaxHalfOpen > 0 && halfOpen >= s.MaxHalfOpen {
+		return false
+	}
+
+	openConnections++
+	cl.connections++
+	if outgoing {
+		halfOpen++
+	}
+	return true
+}
+
+func releaseConnection(cl *Client) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+	openConnections--
+	cl.connections--
+}
+
+// endHalfOpen gives back the half-open slot of an outgoing connection once
+// its handshakes are over
+func endHalfOpen() {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+	halfOpen--
+}
+
+func isBanned(ip string) bool {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+	return bannedIPs[ip]
+}
+
+// recordHashFailure blames the peer that sent a piece that failed its hash
+// check. A piece is downloaded from a single peer, so the failure is all
+// its own. The peer is banned once it sent banThreshold of them, and the
+// return value tells if it is.
+func recordHashFailure(peer *Peer) bool {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	hashFailures[peer.IP]++
+	if hashFailures[peer.IP] >= banThreshold && !bannedIPs[peer.IP] {
+		bannedIPs[peer.IP] = true
+		fmt.Printf("Banned %s (%s) after %d bad pieces\n", peer.String(), peer.Client, hashFailures[peer.IP])
+	}
+	return bannedIPs[peer.IP]
+}
+
+// addCandidates queues peers from a tracker or another source for the
+// pool, leaving out those the IP filter blocks. Private torrents only
+// take peers from their trackers.
+func (c *Client) addCandidates(peers []*Peer) {
+	c.mutex.Lock()
+	for _, p := range peers {
+		if ipFiltered(p.IP) {
+			continue
+		}
+		if c.Torrent.Private && p.Source != PeerSourceTracker {
+			continue
+		}
+		addr := p.String()
+		if _, ok := c.candidates[addr]; ok {
+			continue
+		}
+		c.candidates[addr] = &candidate{ip: p.IP, port: p.Port, source: p.Source}
+	}
+	c.mutex.Unlock()
+
+	c.wakePool()
+}
+
+func (c *Client) wakePool() {
+	select {
+	case c.poolWake <- struct{}{}:
+	default:
+	}
+}
+
+// runPool keeps the torrent connected to as many candidates as the limits
+// allow until ctx is done
+func (c *Client) runPool(ctx context.Context) {
+	ticker := time.NewTicker(poolInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.poolWake:
+		}
+		c.connectCandidates(ctx)
+	}
+}
+
+func (c *Client) connectCandidates(ctx context.Context) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for addr, cand := range c.candidates {
+		if cand.connecting || now.Before(cand.retryAt) {
+			continue
+		}
+		// the filter may have been reloaded since the candidate was added
+		if isBanned(cand.ip) || ipFiltered(cand.ip) {
+			delete(c.candidates, addr)
+			continue
+		}
+		if !reserveConnection(c, true) {
+			return
+		}
+
+		cand.connecting = true
+		go c.connectCandidate(ctx, cand)
+	}
+}
+
+// connectCandidate runs a connection to a candidate, then schedules when
+// to try it again
+func (c *Client) connectCandidate(ctx context.Context, cand *candidate) {
+	defer c.wakePool()
+	defer releaseConnection(c)
+
+	c.mutex.Lock()
+	peer := &Peer{
+		IP:           cand.ip,
+		Port:         cand.port,
+		PeerChoked:   true,
+		ClientChoked: true,
+		Direction:    PeerOutgoing,
+		Source:       cand.source,
+		noUTP:        cand.noUTP,
+	}
+	c.mutex.Unlock()
+
+	conn, receivedHS, err := openPeerConn(ctx, peer, c.Torrent.bencodeTorrent.Info.hash())
+	endHalfOpen()
+
+	self := err == nil && receivedHS.peerID == peerID
+	if err == nil {
+		func() {
+			defer conn.Close()
+			defer closeOnDone(ctx, conn)()
+			runPeer(c, conn, peer, receivedHS)
+		}()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cand.connecting = false
+	cand.noUTP = peer.noUTP
+	if self {
+		delete(c.candidates, net.JoinHostPort(cand.ip, cand.port))
+		return
+	}
+	if ctx.Err() != nil {
+		// the torrent stopped, the peer did nothing wrong
+		return
+	}
+	if err == nil {
+		cand.failures = 0
+		cand.retryAt = time.Now().Add(reconnectDelay)
+		return
+	}
+
+	cand.failures++
+	if cand.failures >= maxConnectFailures {
+		delete(c.candidates, net.JoinHostPort(cand.ip, cand.port))
+		return
+	}
+	backoff := min(retryBackoff<<(cand.failures-1), maxRetryBackoff)
+	cand.retryAt = time.Now().Add(backoff)
+}
@@ -0,0 +1,579 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// qBittorrent WebUI API v2 (https://github.com/qbittorrent/qBittorrent/wiki/WebUI-API-(qBittorrent-4.1)).
+// qBittorrent identifies torrents by info hash, which we map to the ids of
+// the torrents table.
+
+const (
+	qbAPIVersion  = "2.8.3"
+	qbAppVersion  = "v4.6.0"
+	qbCookieName  = "SID"
+	qbSessionTTL  = time.Hour
+	qbSyncHistory = 16
+	// qBittorrent file priorities
+	qbPrioritySkip   = 0
+	qbPriorityNormal = 1
+	qbPriorityHigh   = 6
+)
+
+// QBittorrentHandler serves the qBittorrent WebUI API. When a username is set
+// every endpoint but login needs the session cookie handed out by login.
+type QBittorrentHandler struct {
+	Username string
+	Password string
+	mux      *http.ServeMux
+
+	sessions      map[string]time.Time
+	sessionsMutex sync.Mutex
+
+	// maindata snapshots by response id, for incremental sync
+	syncSnapshots map[int]qbSnapshot
+	lastRID       int
+	syncMutex     sync.Mutex
+}
+
+type qbSnapshot struct {
+	torrents    map[string]map[string]interface{}
+	serverState map[string]interface{}
+}
+
+func NewQBittorrentHandler(username, password string) *QBittorrentHandler {
+	h := &QBittorrentHandler{
+		Username:      username,
+		Password:      password,
+		mux:           http.NewServeMux(),
+		sessions:      make(map[string]time.Time),
+		syncSnapshots: make(map[int]qbSnapshot),
+	}
+
+	h.mux.HandleFunc("/api/v2/auth/login", h.login)
+	h.mux.HandleFunc("/api/v2/auth/logout", h.logout)
+	h.mux.HandleFunc("/api/v2/app/version", h.authed(qbText(qbAppVersion)))
+	h.mux.HandleFunc("/api/v2/app/webapiVersion", h.authed(qbText(qbAPIVersion)))
+	h.mux.HandleFunc("/api/v2/torrents/info", h.authed(h.torrentsInfo))
+	h.mux.HandleFunc("/api/v2/torrents/add", h.authed(h.torrentsAdd))
+	h.mux.HandleFunc("/api/v2/torrents/pause", h.authed(h.torrentsEach(PauseTorrent)))
+	h.mux.HandleFunc("/api/v2/torrents/stop", h.authed(h.torrentsEach(PauseTorrent)))
+	h.mux.HandleFunc("/api/v2/torrents/resume", h.authed(h.torrentsEach(ResumeTorrent)))
+	h.mux.HandleFunc("/api/v2/torrents/start", h.authed(h.torrentsEach(ResumeTorrent)))
+	h.mux.HandleFunc("/api/v2/torrents/delete", h.authed(h.torrentsDelete))
+	h.mux.HandleFunc("/api/v2/torrents/files", h.authed(h.torrentsFiles))
+	h.mux.HandleFunc("/api/v2/transfer/info", h.authed(h.transferInfo))
+	h.mux.HandleFunc("/api/v2/sync/maindata", h.authed(h.syncMaindata))
+	return h
+}
+
+// DefaultWebUIAddr is where the qBittorrent API listens when no address is
+// given
+const DefaultWebUIAddr = "127.0.0.1:8080"
+
+// StartQBittorrentAPI serves the qBittorrent WebUI API on addr,
+// DefaultWebUIAddr if it's empty
+func StartQBittorrentAPI(addr, username, password string) error {
+	if addr == "" {
+		addr = DefaultWebUIAddr
+	}
+	return serveInBackground(addr, NewQBittorrentHandler(username, password), "qBittorrent API", username)
+}
+
+func (h *QBittorrentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *QBittorrentHandler) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !equalSecret(r.FormValue("username"), h.Username) || !equalSecret(r.FormValue("password"), h.Password) {
+		io.WriteString(w, "Fails.")
+		return
+	}
+
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sid := hex.EncodeToString(id)
+
+	h.sessionsMutex.Lock()
+	h.sessions[sid] = time.Now().Add(qbSessionTTL)
+	h.sessionsMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: qbCookieName, Value: sid, Path: "/", HttpOnly: true})
+	io.WriteString(w, "Ok.")
+}
+
+func (h *QBittorrentHandler) logout(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(qbCookieName)
+	if err == nil {
+		h.sessionsMutex.Lock()
+		delete(h.sessions, cookie.Value)
+		h.sessionsMutex.Unlock()
+	}
+}
+
+// authed rejects requests without a live session cookie, sliding its expiry
+// otherwise. Like qBittorrent, it also turns away requests that other sites'
+// pages send, which browsers mark with their Origin or Referer.
+func (h *QBittorrentHandler) authed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if qbCrossSite(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if h.Username == "" {
+			next(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(qbCookieName)
+		if err != nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		h.sessionsMutex.Lock()
+		expiry, ok := h.sessions[cookie.Value]
+		if ok && time.Now().After(expiry) {
+			delete(h.sessions, cookie.Value)
+			ok = false
+		}
+		if ok {
+			h.sessions[cookie.Value] = time.Now().Add(qbSessionTTL)
+		}
+		h.sessionsMutex.Unlock()
+
+		if !ok {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// qbCrossSite tells if the request's Origin or Referer names another host
+func qbCrossSite(r *http.Request) bool {
+	for _, header := range []string{"Origin", "Referer"} {
+		value := r.Header.Get(header)
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || u.Host != r.Host {
+			return true
+		}
+	}
+	return false
+}
+
+func qbText(text string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, text)
+	}
+}
+
+func qbJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *QBittorrentHandler) torrentsInfo(w http.ResponseWriter, r *http.Request) {
+	filter := r.FormValue("filter")
+	// listing filters by hash only when asked to
+	hashes := r.FormValue("hashes")
+	if hashes == "" {
+		hashes = "all"
+	}
+
+	list := []map[string]interface{}{}
+	for _, cl := range qbClients(hashes) {
+		info := qbTorrentInfo(cl)
+		if qbMatchesFilter(info["state"].(string), filter) {
+			list = append(list, info)
+		}
+	}
+	qbJSON(w, list)
+}
+
+func (h *QBittorrentHandler) torrentsAdd(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil && err != http.ErrNotMultipart {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	paused := r.FormValue("paused") == "true" || r.FormValue("stopped") == "true"
+	sequential := r.FormValue("sequentialDownload") == "true"
+
+	var added []*Torrent
+	if r.MultipartForm != nil {
+		for _, header := range r.MultipartForm.File["torrents"] {
+			f, err := header.Open()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			metainfo, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			t, duplicate, err := AddMetainfo(metainfo)
+			if err != nil {
+				io.WriteString(w, "Fails.")
+				return
+			}
+			if !duplicate {
+				added = append(added, t)
+			}
+		}
+	}
+
+	for _, link := range strings.Split(r.FormValue("urls"), "\n") {
+		link = strings.TrimSpace(link)
+		if link == "" {
+			continue
+		}
+
+		var t *Torrent
+		var duplicate bool
+		var err error
+		if strings.HasPrefix(link, "magnet:") {
+			t, duplicate, err = HandleMagnet(r.Context(), link)
+		} else {
+			t, duplicate, err = HandleURL(r.Context(), link)
+		}
+		if err != nil {
+			fmt.Printf("Error adding %s: %v\n", link, err)
+			io.WriteString(w, "Fails.")
+			return
+		}
+		if !duplicate {
+			added = append(added, t)
+		}
+	}
+
+	for _, t := range added {
+		t.mutex.Lock()
+		t.Sequential = sequential
+		t.mutex.Unlock()
+		if paused {
+			EnqueuePaused(t)
+		} else {
+			Enqueue(t)
+		}
+	}
+	io.WriteString(w, "Ok.")
+}
+
+func (h *QBittorrentHandler) torrentsEach(action func(id int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		for _, cl := range qbClients(r.FormValue("hashes")) {
+			err := action(cl.Torrent.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+}
+
+func (h *QBittorrentHandler) torrentsDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deleteFiles := r.FormValue("deleteFiles") == "true"
+	for _, cl := range qbClients(r.FormValue("hashes")) {
+		RemoveTorrent(cl.Torrent.ID, deleteFiles)
+	}
+}
+
+func (h *QBittorrentHandler) torrentsFiles(w http.ResponseWriter, r *http.Request) {
+	clients := qbClients(r.FormValue("hash"))
+	if r.FormValue("hash") == "" || len(clients) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	cl := clients[0]
+	pieceLength := int64(cl.Torrent.bencodeTorrent.Info.PieceLength)
+	files := []map[string]interface{}{}
+	for i, f := range cl.Torrent.files() {
+		progress := 1.0
+		if f.length > 0 {
+			progress = float64(cl.FileCompleted(i)) / float64(f.length)
+		}
+
+		lastPiece := f.offset / pieceLength
+		if f.length > 0 {
+			lastPiece = (f.offset + f.length - 1) / pieceLength
+		}
+
+		files = append(files, map[string]interface{}{
+			"index":        i,
+			"name":         f.path,
+			"size":         f.length,
+			"progress":     progress,
+			"priority":     qbPriority(cl.Torrent.filePriority(i)),
+			"is_seed":      progress == 1,
+			"piece_range":  []int64{f.offset / pieceLength, lastPiece},
+			"availability": -1,
+		})
+	}
+	qbJSON(w, files)
+}
+
+func (h *QBittorrentHandler) transferInfo(w http.ResponseWriter, r *http.Request) {
+	qbJSON(w, qbServerState())
+}
+
+// syncMaindata returns everything on rid 0 or unknown rids, and only what
+// changed since the given rid otherwise
+func (h *QBittorrentHandler) syncMaindata(w http.ResponseWriter, r *http.Request) {
+	var rid int
+	fmt.Sscan(r.FormValue("rid"), &rid)
+
+	current := qbSnapshot{
+		torrents:    make(map[string]map[string]interface{}),
+		serverState: qbServerState(),
+	}
+	for _, cl := range qbClients("all") {
+		current.torrents[cl.Torrent.InfoHash()] = qbTorrentInfo(cl)
+	}
+
+	h.syncMutex.Lock()
+	previous, ok := h.syncSnapshots[rid]
+	h.lastRID++
+	newRID := h.lastRID
+	h.syncSnapshots[newRID] = current
+	delete(h.syncSnapshots, newRID-qbSyncHistory)
+	h.syncMutex.Unlock()
+
+	if !ok {
+		qbJSON(w, map[string]interface{}{
+			"rid":          newRID,
+			"full_update":  true,
+			"torrents":     current.torrents,
+			"server_state": current.serverState,
+		})
+		return
+	}
+
+	changed := make(map[string]map[string]interface{})
+	for hash, info := range current.torrents {
+		diff := qbDiff(previous.torrents[hash], info)
+		if len(diff) > 0 {
+			changed[hash] = diff
+		}
+	}
+
+	removed := []string{}
+	for hash := range previous.torrents {
+		if _, ok := current.torrents[hash]; !ok {
+			removed = append(removed, hash)
+		}
+	}
+
+	resp := map[string]interface{}{"rid": newRID}
+	if len(changed) > 0 {
+		resp["torrents"] = changed
+	}
+	if len(removed) > 0 {
+		resp["torrents_removed"] = removed
+	}
+	if diff := qbDiff(previous.serverState, current.serverState); len(diff) > 0 {
+		resp["server_state"] = diff
+	}
+	qbJSON(w, resp)
+}
+
+// qbDiff returns the keys of current whose values differ from previous
+func qbDiff(previous, current map[string]interface{}) map[string]interface{} {
+	diff := make(map[string]interface{})
+	for key, value := range current {
+		old, ok := previous[key]
+		if !ok || fmt.Sprint(old) != fmt.Sprint(value) {
+			diff[key] = value
+		}
+	}
+	return diff
+}
+
+// qbClients resolves a "|" separated list of hashes, or "all". An empty
+// list selects no torrent.
+func qbClients(hashes string) []*Client {
+	all := hashes == "all"
+	wanted := make(map[string]bool)
+	for _, hash := range strings.Split(hashes, "|") {
+		wanted[strings.ToLower(hash)] = true
+	}
+
+	var selected []*Client
+	for _, t := range LoadedTorrents() {
+		cl := GetClient(t.ID)
+		if cl == nil {
+			continue
+		}
+		if all || wanted[t.InfoHash()] {
+			selected = append(selected, cl)
+		}
+	}
+	return selected
+}
+
+func qbTorrentInfo(cl *Client) map[string]interface{} {
+	t := cl.Torrent.Snapshot()
+	completed := cl.Completed()
+	left := cl.Left()
+	progress := 1.0
+	if completed+left > 0 {
+		progress = float64(completed) / float64(completed+left)
+	}
+
+	stats := torrentStats(t.ID)
+	// 8640000 is qBittorrent's infinite eta
+	eta := int64(8640000)
+	if left > 0 && stats.DownloadSpeed > 0 {
+		eta = left / stats.DownloadSpeed
+	}
+	peers, seeds := cl.peerCounts()
+
+	return map[string]interface{}{
+		"hash":         t.InfoHash(),
+		"name":         t.TorrentName,
+		"size":         completed + left,
+		"total_size":   t.TotalLength,
+		"progress":     progress,
+		"completed":    completed,
+		"amount_left":  left,
+		"dlspeed":      stats.DownloadSpeed,
+		"upspeed":      stats.UploadSpeed,
+		"downloaded":   atomic.LoadInt64(&t.Downloaded),
+		"uploaded":     atomic.LoadInt64(&t.Uploaded),
+		"ratio":        t.ShareRatio(),
+		"eta":          eta,
+		"priority":     t.QueuePosition,
+		"num_seeds":    seeds,
+		"num_leechs":   peers - seeds,
+		"state":        qbState(cl),
+		"seq_dl":       t.Sequential,
+		"save_path":    cl.storage.dir,
+		"seeding_time": atomic.LoadInt64(&t.SeedingTime),
+		"dl_limit":     t.DownloadLimit,
+		"up_limit":     t.UploadLimit,
+		"category":     "",
+		"tags":         "",
+	}
+}
+
+func qbState(cl *Client) string {
+	complete := cl.Complete()
+	switch cl.Torrent.status() {
+	case StatusDownloading:
+		if cl.PeerCount() == 0 {
+			return "stalledDL"
+		}
+		return "downloading"
+	case StatusSeeding:
+		if cl.PeerCount() == 0 {
+			return "stalledUP"
+		}
+		return "uploading"
+	case StatusQueued:
+		if complete {
+			return "queuedUP"
+		}
+		return "queuedDL"
+	default:
+		if complete {
+			return "pausedUP"
+		}
+		return "pausedDL"
+	}
+}
+
+func qbMatchesFilter(state, filter string) bool {
+	switch filter {
+	case "", "all":
+		return true
+	case "downloading":
+		return strings.HasSuffix(state, "DL") || state == "downloading"
+	case "seeding":
+		return strings.HasSuffix(state, "UP") || state == "uploading"
+	case "completed":
+		return strings.HasSuffix(state, "UP") || state == "uploading"
+	case "paused", "stopped":
+		return strings.HasPrefix(state, "paused")
+	case "active":
+		return state == "downloading" || state == "uploading"
+	case "inactive":
+		return state != "downloading" && state != "uploading"
+	case "stalled":
+		return strings.HasPrefix(state, "stalled")
+	default:
+		return false
+	}
+}
+
+func qbPriority(priority FilePriority) int {
+	switch priority {
+	case PrioritySkip:
+		return qbPrioritySkip
+	case PriorityHigh:
+		return qbPriorityHigh
+	default:
+		return qbPriorityNormal
+	}
+}
+
+func qbServerState() map[string]interface{} {
+	var downloaded, uploaded int64
+	for _, t := range LoadedTorrents() {
+		downloaded += atomic.LoadInt64(&t.Downloaded)
+		uploaded += atomic.LoadInt64(&t.Uploaded)
+	}
+
+	downloadSpeed, uploadSpeed := totalSpeeds()
+	return map[string]interface{}{
+		"dl_info_speed":     downloadSpeed,
+		"up_info_speed":     uploadSpeed,
+		"dl_info_data":      downloaded,
+		"up_info_data":      uploaded,
+		"dl_rate_limit":     downloadLimiter.Rate(),
+		"up_rate_limit":     uploadLimiter.Rate(),
+		"dht_nodes":         0,
+		"connection_status": "connected",
+	}
+}
@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQBittorrentDelete(t *testing.T) {
+	newTestSession(t)
+
+	dir := t.TempDir()
+	var hashes []string
+	for _, name := range []string{"one.bin", "two.bin"} {
+		src := filepath.Join(dir, name)
+		writeTestFile(t, src, 20000)
+		torrent := addTestTorrent(t, src, 16<<10)
+		EnqueuePaused(torrent)
+		hashes = append(hashes, torrent.InfoHash())
+	}
+
+	server := httptest.NewServer(NewQBittorrentHandler("", ""))
+	defer server.Close()
+
+	remaining := func() int {
+		return len(qbClients("all"))
+	}
+	post := func(form url.Values, header http.Header) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v2/torrents/delete", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	resp, err := http.Get(server.URL + "/api/v2/torrents/delete?hashes=all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || remaining() != 2 {
+		t.Errorf("GET delete: got %s with %d torrents left, want 405 and 2", resp.Status, remaining())
+	}
+
+	cross := http.Header{"Origin": {"http://example.com"}}
+	if status := post(url.Values{"hashes": {"all"}}, cross); status != http.StatusUnauthorized || remaining() != 2 {
+		t.Errorf("cross-site delete: got %d with %d torrents left, want 401 and 2", status, remaining())
+	}
+
+	if status := post(url.Values{"deleteFiles": {"true"}}, nil); status != http.StatusOK || remaining() != 2 {
+		t.Errorf("delete without hashes: got %d with %d torrents left, want 200 and 2", status, remaining())
+	}
+
+	post(url.Values{"hashes": {strings.ToUpper(hashes[0])}}, nil)
+	if remaining() != 1 || len(qbClients(hashes[1])) != 1 {
+		t.Error("deleting one hash didn't remove just that torrent")
+	}
+
+	post(url.Values{"hashes": {"all"}}, nil)
+	if remaining() != 0 {
+		t.Errorf("deleting all left %d torrents", remaining())
+	}
+}
@@ -0,0 +1,280 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	StatusQueued      = "queued"
+	StatusDownloading = "downloading"
+	StatusSeeding     = "seeding"
+	StatusPaused      = "paused"
+)
+
+// QueueSettings caps how many torrents run at once, 0 meaning no cap
+type QueueSettings struct {
+	MaxActiveDownloads int `json:"maxActiveDownloads"`
+	MaxActiveSeeds     int `json:"maxActiveSeeds"`
+}
+
+type QueueMove int
+
+const (
+	MoveUp QueueMove = iota
+	MoveDown
+	MoveTop
+	MoveBottom
+)
+
+var (
+	queueSettings = QueueSettings{MaxActiveDownloads: 3, MaxActiveSeeds: 3}
+	// queueCtx is the context torrents are started with
+	queueCtx   = context.Background()
+	queueMutex sync.Mutex
+)
+
+// InitQueue sets the context started torrents run in
+func InitQueue(ctx context.Context) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	queueCtx = ctx
+}
+
+func GetQueueSettings() QueueSettings {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	return queueSettings
+}
+
+func SetQueueSettings(s QueueSettings) error {
+	if s.MaxActiveDownloads < 0 || s.MaxActiveSeeds < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+
+	queueMutex.Lock()
+	queueSettings = s
+	queueMutex.Unlock()
+
+	updateQueue()
+	return nil
+}
+
+// Enqueue creates the client of a torrent and starts it when a slot is free
+func Enqueue(t *Torrent) *Client {
+	if cl := GetClient(t.ID); cl != nil {
+		return cl
+	}
+
+	cl := NewClient(t)
+	// peers that sent the metadata of a magnet link are likely to have data
+	cl.addCandidates(t.takeMagnetPeers())
+	queueMutex.Lock()
+	t.mutex.Lock()
+	if t.Status != StatusPaused {
+		t.Status = StatusQueued
+	}
+	t.mutex.Unlock()
+	queueMutex.Unlock()
+	updateQueue()
+	return cl
+}
+
+// EnqueuePaused creates the client of a torrent added paused, saving the
+// status so the torrent stays paused after a restart
+func EnqueuePaused(t *Torrent) *Client {
+	queueMutex.Lock()
+	setStatus(t, StatusPaused)
+	queueMutex.Unlock()
+	return Enqueue(t)
+}
+
+func PauseTorrent(torrentID int) error {
+	return setPaused(torrentID, true)
+}
+
+func ResumeTorrent(torrentID int) error {
+	return setPaused(torrentID, false)
+}
+
+func setPaused(torrentID int, paused bool) error {
+	t := GetTorrent(torrentID)
+	if t == nil {
+		return fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	queueMutex.Lock()
+	if paused {
+		setStatus(t, StatusPaused)
+	} else if t.Status == StatusPaused {
+		setStatus(t, StatusQueued)
+	}
+	queueMutex.Unlock()
+
+	updateQueue()
+	return nil
+}
+
+// RemoveTorrent stops a torrent and deletes it from the database, and
+// optionally its downloaded files
+func RemoveTorrent(torrentID int, deleteData bool) {
+	cl := GetClient(torrentID)
+	if cl != nil {
+		cl.Stop()
+		removeClient(torrentID)
+
+		if deleteData {
+			err := cl.storage.Delete()
+			if err != nil {
+				fmt.Println("Error deleting torrent data:", err)
+			}
+		}
+	}
+
+	Remove(torrentID)
+	unregisterTorrent(torrentID)
+	updateQueue()
+}
+
+// MoveInQueue changes the position of a torrent among the loaded ones
+func MoveInQueue(torrentID int, move QueueMove) error {
+	queueMutex.Lock()
+	order := queueOrder()
+	from := -1
+	for i, t := range order {
+		if t.ID == torrentID {
+			from = i
+		}
+	}
+	if from == -1 {
+		queueMutex.Unlock()
+		return fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	to := from
+	switch move {
+	case MoveUp:
+		to = max(from-1, 0)
+	case MoveDown:
+		to = min(from+1, len(order)-1)
+	case MoveTop:
+		to = 0
+	case MoveBottom:
+		to = len(order) - 1
+	default:
+		queueMutex.Unlock()
+		return fmt.Errorf("invalid queue move %d", move)
+	}
+
+	// reuse the positions the loaded torrents already hold, so rows of
+	// torrents that aren't loaded keep theirs
+	positions := make([]int, len(order))
+	for i, t := range order {
+		positions[i] = t.QueuePosition
+	}
+
+	moved := order[from]
+	order = append(order[:from], order[from+1:]...)
+	order = append(order[:to], append([]*Torrent{moved}, order[to:]...)...)
+
+	for i, t := range order {
+		if t.QueuePosition == positions[i] {
+			continue
+		}
+		t.mutex.Lock()
+		t.QueuePosition = positions[i]
+		t.mutex.Unlock()
+		err := updateQueuePosition(t.ID, t.QueuePosition)
+		if err != nil {
+			queueMutex.Unlock()
+			return err
+		}
+	}
+	queueMutex.Unlock()
+
+	updateQueue()
+	return nil
+}
+
+// queueOrder returns the loaded torrents by queue position. queueMutex must be held.
+func queueOrder() []*Torrent {
+	torrentsMutex.Lock()
+	order := make([]*Torrent, 0, len(torrents))
+	for _, t := range torrents {
+		order = append(order, t)
+	}
+	torrentsMutex.Unlock()
+
+	sort.Slice(order, func(i, j int) bool {
+		return order[i].QueuePosition < order[j].QueuePosition
+	})
+	return order
+}
+
+// updateQueue starts torrents from the top of the queue while there are free
+// slots and stops the ones past the limits
+func updateQueue() {
+	if shuttingDown.Load() {
+		return
+	}
+
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	downloads, seeds := 0, 0
+	for _, t := range queueOrder() {
+		cl := GetClient(t.ID)
+		if cl == nil {
+			continue
+		}
+
+		status := StatusQueued
+		complete := cl.Complete()
+		switch {
+		case t.Status == StatusPaused:
+			status = StatusPaused
+		case complete && (queueSettings.MaxActiveSeeds == 0 || seeds < queueSettings.MaxActiveSeeds):
+			status = StatusSeeding
+			seeds++
+		case !complete && (queueSettings.MaxActiveDownloads == 0 || downloads < queueSettings.MaxActiveDownloads):
+			status = StatusDownloading
+			downloads++
+		}
+
+		if status == StatusDownloading || status == StatusSeeding {
+			cl.Start(queueCtx)
+		} else {
+			cl.Stop()
+		}
+
+		setStatus(t, status)
+	}
+}
+
+// setStatus saves and announces a status change. queueMutex must be held.
+func setStatus(t *Torrent, status string) {
+	if status == t.Status {
+		return
+	}
+
+	t.mutex.Lock()
+	t.Status = status
+	t.mutex.Unlock()
+	err := updateStatus(t.ID, status)
+	if err != nil {
+		fmt.Println("Error saving torrent status:", err)
+	}
+	publish(Event{Type: EventTorrentState, TorrentID: t.ID, Data: StateEvent{Status: status}})
+}
+
+// torrentCompleted frees the download slot of a finished torrent
+func torrentCompleted(cl *Client) {
+	fmt.Println("Torrent completed:", cl.Torrent.TorrentName)
+	select {
+	case cl.trackerCompleted <- struct{}{}:
+	default:
+	}
+	go updateQueue()
+}
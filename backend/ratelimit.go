@@ -0,0 +1,235 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket refilled at rate bytes per second, holding at
+// most one second worth of tokens. A rate of 0 means unlimited.
+type RateLimiter struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rate = rate
+	l.tokens = min(l.tokens, float64(rate))
+}
+
+func (l *RateLimiter) Rate() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+// WaitN takes n tokens, sleeping until the bucket has paid them back if it
+// went into debt
+func (l *RateLimiter) WaitN(n int) {
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.rate))
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	time.Sleep(wait)
+}
+
+// BandwidthSettings are the global limits, in bytes per second with 0 meaning
+// unlimited. The alternative limits are used instead while AltEnabled is
+// set, or between AltFrom and AltTo (hours of the day, local time) when the
+// schedule is enabled.
+type BandwidthSettings struct {
+	DownloadLimit      int64 `json:"downloadLimit"`
+	UploadLimit        int64 `json:"uploadLimit"`
+	PeerDownloadLimit  int64 `json:"peerDownloadLimit"`
+	PeerUploadLimit    int64 `json:"peerUploadLimit"`
+	AltDownloadLimit   int64 `json:"altDownloadLimit"`
+	AltUploadLimit     int64 `json:"altUploadLimit"`
+	AltEnabled         bool  `json:"altEnabled"`
+	AltScheduleEnabled bool  `json:"altScheduleEnabled"`
+	AltFrom            int   `json:"altFrom"`
+	AltTo              int   `json:"altTo"`
+}
+
+var (
+	bandwidth      BandwidthSettings
+	bandwidthMutex sync.Mutex
+
+	downloadLimiter = NewRateLimiter(0)
+	uploadLimiter   = NewRateLimiter(0)
+
+	// open peer connections, so per-peer limits can be changed at runtime
+	limitedConns      = make(map[*limitedConn]bool)
+	limitedConnsMutex sync.Mutex
+
+	schedulerOnce sync.Once
+)
+
+func GetBandwidthSettings() BandwidthSettings {
+	bandwidthMutex.Lock()
+	defer bandwidthMutex.Unlock()
+	return bandwidth
+}
+
+func SetBandwidthSettings(s BandwidthSettings) error {
+	if s.DownloadLimit < 0 || s.UploadLimit < 0 || s.PeerDownloadLimit < 0 || s.PeerUploadLimit < 0 ||
+		s.AltDownloadLimit < 0 || s.AltUploadLimit < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+
+	if s.AltFrom < 0 || s.AltFrom > 23 || s.AltTo < 0 || s.AltTo > 23 {
+		return fmt.Errorf("schedule hours must be between 0 and 23")
+	}
+
+	bandwidthMutex.Lock()
+	bandwidth = s
+	bandwidthMutex.Unlock()
+
+	applyBandwidth(time.Now())
+	return nil
+}
+
+// SetTorrentBandwidth sets the limits of a single torrent, 0 meaning unlimited
+func SetTorrentBandwidth(torrentID int, downloadLimit, uploadLimit int64) error {
+	if downloadLimit < 0 || uploadLimit < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+
+	t := GetTorrent(torrentID)
+	if t == nil {
+		return fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	t.mutex.Lock()
+	t.DownloadLimit = downloadLimit
+	t.UploadLimit = uploadLimit
+	t.mutex.Unlock()
+	cl := clientFor(t)
+	if cl != nil {
+		cl.downloadLimiter.SetRate(downloadLimit)
+		cl.uploadLimiter.SetRate(uploadLimit)
+	}
+	return nil
+}
+
+// StartBandwidthScheduler switches between normal and alternative limits
+// as the schedule says
+func StartBandwidthScheduler() {
+	schedulerOnce.Do(func() {
+		go func() {
+			for now := range time.Tick(time.Minute) {
+				applyBandwidth(now)
+			}
+		}()
+	})
+}
+
+func applyBandwidth(now time.Time) {
+	s := GetBandwidthSettings()
+	if s.AltEnabled || (s.AltScheduleEnabled && inSchedule(now.Hour(), s.AltFrom, s.AltTo)) {
+		downloadLimiter.SetRate(s.AltDownloadLimit)
+		uploadLimiter.SetRate(s.AltUploadLimit)
+	} else {
+		downloadLimiter.SetRate(s.DownloadLimit)
+		uploadLimiter.SetRate(s.UploadLimit)
+	}
+
+	limitedConnsMutex.Lock()
+	defer limitedConnsMutex.Unlock()
+	for c := range limitedConns {
+		c.peerDownload.SetRate(s.PeerDownloadLimit)
+		c.peerUpload.SetRate(s.PeerUploadLimit)
+	}
+}
+
+// inSchedule tells if hour falls in [from, to), wrapping past midnight
+func inSchedule(hour, from, to int) bool {
+	if from <= to {
+		return hour >= from && hour < to
+	}
+	return hour >= from || hour < to
+}
+
+// limitedConn throttles a peer connection through the global, torrent and
+// peer limiters
+type limitedConn struct {
+	net.Conn
+	client       *Client
+	peerDownload *RateLimiter
+	peerUpload   *RateLimiter
+}
+
+func newLimitedConn(conn net.Conn, cl *Client) *limitedConn {
+	s := GetBandwidthSettings()
+	c := &limitedConn{
+		Conn:         conn,
+		client:       cl,
+		peerDownload: NewRateLimiter(s.PeerDownloadLimit),
+		peerUpload:   NewRateLimiter(s.PeerUploadLimit),
+	}
+
+	limitedConnsMutex.Lock()
+	limitedConns[c] = true
+	limitedConnsMutex.Unlock()
+	return c
+}
+
+// Read pays for data after it arrives, which slows down further reads and
+// so the rate the peer can send at
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		downloadLimiter.WaitN(n)
+		c.client.downloadLimiter.WaitN(n)
+		c.peerDownload.WaitN(n)
+	}
+	return n, err
+}
+
+// Write pays for data before sending it, a block at a time
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, BlockSize)
+		uploadLimiter.WaitN(n)
+		c.client.uploadLimiter.WaitN(n)
+		c.peerUpload.WaitN(n)
+
+		n, err := c.Conn.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *limitedConn) Close() error {
+	limitedConnsMutex.Lock()
+	delete(limitedConns, c)
+	limitedConnsMutex.Unlock()
+	return c.Conn.Close()
+}
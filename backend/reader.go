@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+var nextReaderID atomic.Int64
+
+// FileReader reads a single file of a torrent while it downloads. Reads block
+// until the pieces they need are verified, and the picker fetches the pieces
+// right ahead of the read position first.
+type FileReader struct {
+	client *Client
+	file   torrentFile
+	id     int
+	pos    int64
+	// guarded by client.mutex
+	closed bool
+}
+
+func (c *Client) NewFileReader(fileIndex int) (*FileReader, error) {
+	files := c.Torrent.files()
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, fmt.Errorf("invalid file index %d", fileIndex)
+	}
+
+	return &FileReader{
+		client: c,
+		file:   files[fileIndex],
+		id:     int(nextReaderID.Add(1)),
+	}, nil
+}
+
+// Size returns the length of the file
+func (r *FileReader) Size() int64 {
+	return r.file.length
+}
+
+// pieceAt returns the piece holding a position of the file
+func (r *FileReader) pieceAt(pos int64) int {
+	return int((r.file.offset + pos) / int64(r.client.Torrent.bencodeTorrent.Info.PieceLength))
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.pos >= r.file.length {
+		return 0, io.EOF
+	}
+
+	offset := r.file.offset + r.pos
+	index := r.pieceAt(r.pos)
+	r.client.picker.SetReadPosition(r.id, index)
+
+	// a stopped torrent won't get the piece, Stop wakes us up to notice
+	r.client.mutex.Lock()
+	for !r.client.Bitfield.HasPiece(index) && !r.closed && r.client.cancel != nil {
+		r.client.pieceDone.Wait()
+	}
+	closed := r.closed
+	missing := !r.client.Bitfield.HasPiece(index)
+	r.client.mutex.Unlock()
+	if closed {
+		return 0, errors.New("reader closed")
+	}
+	if missing {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	_, pieceEnd := r.client.Torrent.pieceSpan(index)
+	n := min(int64(len(p)), pieceEnd-offset, r.file.length-r.pos)
+	read, err := r.client.storage.ReadAt(p[:n], offset)
+	r.pos += int64(read)
+	return read, err
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.file.length + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close unblocks pending reads and releases the readahead window
+func (r *FileReader) Close() error {
+	r.client.mutex.Lock()
+	r.closed = true
+	r.client.pieceDone.Broadcast()
+	r.client.mutex.Unlock()
+
+	r.client.picker.RemoveReader(r.id)
+	return nil
+}
@@ -0,0 +1,182 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	GoalActionPause          = "pause"
+	GoalActionRemove         = "remove"
+	GoalActionRemoveWithData = "remove-with-data"
+)
+
+// SeedingGoals stop seeding once any of the set goals is reached. A zero
+// ratio or time means that goal is not set. Times are in minutes, and idle
+// time counts from the last upload.
+type SeedingGoals struct {
+	Ratio       float64 `json:"ratio"`
+	SeedingTime int     `json:"seedingTime"`
+	IdleTime    int     `json:"idleTime"`
+	Action      string  `json:"action"`
+}
+
+// seedingCheckInterval is how often seeding time is counted and goals checked
+const seedingCheckInterval = 30 * time.Second
+
+var (
+	seedingGoals      = SeedingGoals{Action: GoalActionPause}
+	seedingGoalsMutex sync.Mutex
+
+	seedingMonitorOnce sync.Once
+)
+
+func GetSeedingGoals() SeedingGoals {
+	seedingGoalsMutex.Lock()
+	defer seedingGoalsMutex.Unlock()
+	return seedingGoals
+}
+
+func SetSeedingGoals(goals SeedingGoals) error {
+	err := goals.validate()
+	if err != nil {
+		return err
+	}
+
+	seedingGoalsMutex.Lock()
+	seedingGoals = goals
+	seedingGoalsMutex.Unlock()
+	return nil
+}
+
+// SetTorrentSeedingGoals overrides the global goals for one torrent, nil
+// going back to the global ones
+func SetTorrentSeedingGoals(torrentID int, goals *SeedingGoals) error {
+	if goals != nil {
+		err := goals.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	t := GetTorrent(torrentID)
+	if t == nil {
+		return fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	t.mutex.Lock()
+	t.SeedingGoals = goals
+	t.mutex.Unlock()
+	return saveSeedingGoals(torrentID, goals)
+}
+
+func (g SeedingGoals) validate() error {
+	if g.Ratio < 0 || g.SeedingTime < 0 || g.IdleTime < 0 {
+		return fmt.Errorf("goals can't be negative")
+	}
+
+	switch g.Action {
+	case GoalActionPause, GoalActionRemove, GoalActionRemoveWithData:
+		return nil
+	default:
+		return fmt.Errorf("invalid goal action %q", g.Action)
+	}
+}
+
+// ShareRatio is uploaded over downloaded bytes. Torrents that were never
+// downloaded by us count their size instead.
+func (t *Torrent) ShareRatio() float64 {
+	downloaded := atomic.LoadInt64(&t.Downloaded)
+	if downloaded == 0 {
+		downloaded = t.TotalLength
+	}
+	if downloaded == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&t.Uploaded)) / float64(downloaded)
+}
+
+// StartSeedingMonitor periodically saves transfer totals and applies seeding goals
+func StartSeedingMonitor() {
+	seedingMonitorOnce.Do(func() {
+		go func() {
+			for range time.Tick(seedingCheckInterval) {
+				checkSeedingGoals(seedingCheckInterval)
+			}
+		}()
+	})
+}
+
+func checkSeedingGoals(elapsed time.Duration) {
+	clientsMutex.Lock()
+	active := make([]*Client, 0, len(clients))
+	for _, cl := range clients {
+		active = append(active, cl)
+	}
+	clientsMutex.Unlock()
+
+	for _, cl := range active {
+		t := cl.Torrent
+		status := t.status()
+		if status == StatusSeeding {
+			atomic.AddInt64(&t.SeedingTime, int64(elapsed.Seconds()))
+		}
+		t.mutex.Lock()
+		t.Ratio = t.ShareRatio()
+		t.mutex.Unlock()
+
+		err := saveResumeData(cl)
+		if err != nil {
+			fmt.Println("Error saving resume data:", err)
+		}
+
+		if status != StatusSeeding {
+			continue
+		}
+
+		goals := GetSeedingGoals()
+		if own := t.Snapshot().SeedingGoals; own != nil {
+			goals = *own
+		}
+
+		reason := goalReached(cl, goals, time.Now())
+		if reason == "" {
+			continue
+		}
+
+		fmt.Printf("Torrent %s reached its %s goal, applying %s\n", t.TorrentName, reason, goals.Action)
+		switch goals.Action {
+		case GoalActionPause:
+			err = PauseTorrent(t.ID)
+		case GoalActionRemove:
+			RemoveTorrent(t.ID, false)
+		case GoalActionRemoveWithData:
+			RemoveTorrent(t.ID, true)
+		}
+		if err != nil {
+			fmt.Println("Error applying seeding goal:", err)
+		}
+	}
+}
+
+// goalReached returns the name of the first goal the torrent reached, if any
+func goalReached(cl *Client, goals SeedingGoals, now time.Time) string {
+	t := cl.Torrent
+	if goals.Ratio > 0 && t.ShareRatio() >= goals.Ratio {
+		return "ratio"
+	}
+
+	if goals.SeedingTime > 0 && atomic.LoadInt64(&t.SeedingTime) >= int64(goals.SeedingTime)*60 {
+		return "seeding time"
+	}
+
+	if goals.IdleTime > 0 {
+		lastActivity := time.Unix(cl.lastUpload.Load(), 0)
+		if now.Sub(lastActivity) >= time.Duration(goals.IdleTime)*time.Minute {
+			return "idle time"
+		}
+	}
+	return ""
+}
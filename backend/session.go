@@ -0,0 +1,154 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// stoppedAnnounceTimeout bounds the stopped announce to each tracker
+const stoppedAnnounceTimeout = 5 * time.Second
+
+// shuttingDown keeps the queue from starting torrents again during Shutdown
+var shuttingDown atomic.Bool
+
+// StartSession opens the database, resumes saved torrents and starts the
+// background jobs. It's shared by the GUI and the daemon.
+func StartSession(ctx context.Context) error {
+	InitDB()
+	InitQueue(ctx)
+
+	err := StartStreamServer()
+	if err != nil {
+		fmt.Println("Error starting stream server:", err)
+	}
+
+	err = StartPeerListener()
+	if err != nil {
+		fmt.Println("Error listening for peers:", err)
+	}
+
+	err = StartUTP()
+	if err != nil {
+		fmt.Println("Error listening for uTP peers:", err)
+	}
+
+	StartBandwidthScheduler()
+	StartSeedingMonitor()
+	StartStatsAggregator()
+	return LoadTorrents()
+}
+
+// LoadTorrents resumes the torrents saved by a previous session
+func LoadTorrents() error {
+	rows, err := getResumeRows()
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if GetTorrent(row.torrent.ID) != nil {
+			continue
+		}
+
+		bcode, err := getBencode(bytes.NewReader(row.metainfo))
+		if err != nil {
+			fmt.Printf("Error reading saved torrent %d: %v\n", row.torrent.ID, err)
+			continue
+		}
+
+		t := NewTorrent(bcode)
+		t.metainfo = row.metainfo
+		t.ID = row.torrent.ID
+		t.Status = row.torrent.Status
+		t.QueuePosition = row.torrent.QueuePosition
+		t.Uploaded = row.torrent.Uploaded
+		t.Downloaded = row.torrent.Downloaded
+		t.SeedingTime = row.torrent.SeedingTime
+		t.SeedingGoals = row.torrent.SeedingGoals
+		t.Ratio = t.ShareRatio()
+		t.resumeParts = row.parts
+
+		err = loadFilePriorities(t)
+		if err != nil {
+			return err
+		}
+		registerTorrent(t)
+
+		cl := NewClient(t)
+		if len(row.bitfield) == len(cl.Bitfield) {
+			copy(cl.Bitfield, row.bitfield)
+		}
+		cl.picker.UpdatePriorities(t)
+	}
+
+	updateQueue()
+	return nil
+}
+
+// Shutdown saves resume data and tells the trackers of running torrents
+// that we're leaving
+func Shutdown() {
+	shuttingDown.Store(true)
+
+	clientsMutex.Lock()
+	all := make([]*Client, 0, len(clients))
+	for _, cl := range clients {
+		all = append(all, cl)
+	}
+	clientsMutex.Unlock()
+
+	for _, cl := range all {
+		cl.Stop()
+
+		err := saveResumeData(cl)
+		if err != nil {
+			fmt.Printf("Error saving resume data of %s: %v\n", cl.Torrent.TorrentName, err)
+		}
+	}
+
+	// the tracker loops announce stopped as they end
+	for _, cl := range all {
+		cl.waitTracker()
+	}
+}
+
+// serveInBackground listens on addr and serves handler until the process
+// exits. Without a username there's no authentication, so only loopback
+// addresses are allowed.
+func serveInBackground(addr string, handler http.Handler, name, username string) error {
+	if username == "" && !isLoopbackAddr(addr) {
+		return fmt.Errorf("%s on %s needs a username, or a loopback address", name, addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := http.Serve(listener, handler)
+		if err != nil {
+			fmt.Printf("%s server stopped: %v\n", name, err)
+		}
+	}()
+	return nil
+}
+
+// isLoopbackAddr tells if addr only listens on this machine. An empty host
+// listens on every interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// statsInterval is how often stats are computed and pushed
+	statsInterval = time.Second
+	// rateSamples is how many intervals transfer rates are averaged over
+	rateSamples = 5
+)
+
+// TorrentStats is the live state of a torrent. Rates are in bytes per
+// second, the ETA is in seconds and 0 when unknown.
+type TorrentStats struct {
+	ID            int     `json:"id"`
+	Progress      float64 `json:"progress"`
+	DownloadSpeed int64   `json:"downloadSpeed"`
+	UploadSpeed   int64   `json:"uploadSpeed"`
+	ETA           int64   `json:"eta"`
+	Peers         int     `json:"peers"`
+	TotalPeers    int     `json:"totalPeers"`
+	Seeds         int     `json:"seeds"`
+	TotalSeeds    int     `json:"totalSeeds"`
+	Availability  float64 `json:"availability"`
+	Wasted        int64   `json:"wasted"`
+}
+
+// rateMeter turns byte counters into a moving average rate
+type rateMeter struct {
+	last    int64
+	samples []int64
+}
+
+func (m *rateMeter) update(total int64, elapsed time.Duration) int64 {
+	m.samples = append(m.samples, total-m.last)
+	if len(m.samples) > rateSamples {
+		m.samples = m.samples[1:]
+	}
+	m.last = total
+
+	var sum int64
+	for _, s := range m.samples {
+		sum += s
+	}
+	return int64(float64(sum) / (elapsed.Seconds() * float64(len(m.samples))))
+}
+
+type statsState struct {
+	download rateMeter
+	upload   rateMeter
+	stats    TorrentStats
+	// sent is the JSON form of the stats last pushed
+	sent map[string]interface{}
+}
+
+var (
+	statsStates = make(map[int]*statsState)
+	statsMutex  sync.Mutex
+
+	statsAggregatorOnce sync.Once
+)
+
+// StartStatsAggregator computes the stats of every torrent each second and
+// publishes what changed
+func StartStatsAggregator() {
+	statsAggregatorOnce.Do(func() {
+		go func() {
+			for range time.Tick(statsInterval) {
+				updateStats(statsInterval)
+			}
+		}()
+	})
+}
+
+// GetStats returns the latest stats of every loaded torrent
+func GetStats() []TorrentStats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	all := make([]TorrentStats, 0, len(statsStates))
+	for _, state := range statsStates {
+		all = append(all, state.stats)
+	}
+	return all
+}
+
+// torrentStats returns the latest stats of a torrent, zero until the
+// aggregator first ran for it
+func torrentStats(torrentID int) TorrentStats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	if state := statsStates[torrentID]; state != nil {
+		return state.stats
+	}
+	return TorrentStats{ID: torrentID}
+}
+
+// totalSpeeds sums the download and upload speeds of every torrent
+func totalSpeeds() (int64, int64) {
+	var download, upload int64
+	for _, stats := range GetStats() {
+		download += stats.DownloadSpeed
+		upload += stats.UploadSpeed
+	}
+	return download, upload
+}
+
+func updateStats(elapsed time.Duration) {
+	clientsMutex.Lock()
+	all := make(map[int]*Client, len(clients))
+	for id, cl := range clients {
+		all[id] = cl
+	}
+	clientsMutex.Unlock()
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	for id := range statsStates {
+		if all[id] == nil {
+			delete(statsStates, id)
+		}
+	}
+
+	for id, cl := range all {
+		state := statsStates[id]
+		if state == nil {
+			t := cl.Torrent
+			state = &statsState{}
+			state.download.last = atomic.LoadInt64(&t.Downloaded)
+			state.upload.last = atomic.LoadInt64(&t.Uploaded)
+			statsStates[id] = state
+		}
+
+		cl.updatePeerRates(elapsed)
+		state.stats = collectStats(cl, state, elapsed)
+		cl.Torrent.mutex.Lock()
+		cl.Torrent.Progress = state.stats.Progress
+		cl.Torrent.mutex.Unlock()
+
+		diff, err := state.diff()
+		if err != nil {
+			fmt.Println("Error computing stats:", err)
+			continue
+		}
+		if len(diff) > 0 {
+			publish(Event{Type: EventStatsTick, TorrentID: id, Data: diff})
+		}
+	}
+}
+
+func collectStats(cl *Client, state *statsState, elapsed time.Duration) TorrentStats {
+	t := cl.Torrent
+	completed, left := cl.Completed(), cl.Left()
+
+	stats := TorrentStats{
+		ID:            t.ID,
+		DownloadSpeed: state.download.update(atomic.LoadInt64(&t.Downloaded), elapsed),
+		UploadSpeed:   state.upload.update(atomic.LoadInt64(&t.Uploaded), elapsed),
+		Availability:  cl.picker.Availability(),
+		Wasted:        cl.wasted.Load(),
+	}
+
+	if wanted := completed + left; wanted > 0 {
+		stats.Progress = float64(completed) / float64(wanted) * 100
+	} else {
+		stats.Progress = 100
+	}
+
+	if left > 0 && stats.DownloadSpeed > 0 {
+		stats.ETA = left / stats.DownloadSpeed
+	}
+
+	stats.Peers, stats.Seeds = cl.peerCounts()
+	stats.TotalSeeds = max(int(cl.trackerSeeds.Load()), stats.Seeds)
+	stats.TotalPeers = max(int(cl.trackerSeeds.Load()+cl.trackerLeechers.Load()), stats.Peers)
+	return stats
+}
+
+// diff returns the fields that changed since the last call
+func (s *statsState) diff() (StatsEvent, error) {
+	data, err := json.Marshal(s.stats)
+	if err != nil {
+		return nil, err
+	}
+
+	var current map[string]interface{}
+	err = json.Unmarshal(data, &current)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := StatsEvent{}
+	for key, value := range current {
+		if s.sent == nil || s.sent[key] != value {
+			diff[key] = value
+		}
+	}
+	s.sent = current
+	return diff, nil
+}
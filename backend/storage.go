@@ -0,0 +1,276 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DownloadDir is where torrent data is written
+var DownloadDir = "downloads"
+
+// Storage writes verified pieces to the torrent's files. Pieces that overlap a
+// skipped file are also kept whole in a parts file, so the unwanted side of a
+// boundary piece never creates that file on disk. The parts file holds those
+// pieces one after another, in slots of a piece length.
+type Storage struct {
+	torrent *Torrent
+	dir     string
+	// parts maps the pieces in the parts file to their slot
+	parts map[int]int
+	// slots holds the piece in each slot of the parts file, -1 when free
+	slots []int
+	mutex sync.Mutex
+}
+
+func NewStorage(t *Torrent) *Storage {
+	s := &Storage{
+		torrent: t,
+		dir:     DownloadDir,
+		parts:   make(map[int]int),
+	}
+	for slot, index := range t.resumeParts {
+		_, taken := s.parts[index]
+		if index < 0 || index >= t.bencodeTorrent.NumPieces() || taken {
+			index = -1
+		} else {
+			s.parts[index] = slot
+		}
+		s.slots = append(s.slots, index)
+	}
+	return s
+}
+
+// partsIndex returns the piece in each slot of the parts file, for resume data
+func (s *Storage) partsIndex() []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]int(nil), s.slots...)
+}
+
+// partsPath is named after the info hash, as torrents may share a name
+func (s *Storage) partsPath() string {
+	return filepath.Join(s.dir, "."+s.torrent.InfoHash()+".parts")
+}
+
+// partsOffset is where a slot starts in the parts file
+func (s *Storage) partsOffset(slot int) int64 {
+	return int64(slot) * int64(s.torrent.bencodeTorrent.Info.PieceLength)
+}
+
+// partsSlot returns the slot of a piece in the parts file, taking a free
+// one if the piece isn't there yet
+func (s *Storage) partsSlot(index int) int {
+	if slot, ok := s.parts[index]; ok {
+		return slot
+	}
+	slot := 0
+	for slot < len(s.slots) && s.slots[slot] != -1 {
+		slot++
+	}
+	if slot == len(s.slots) {
+		s.slots = append(s.slots, -1)
+	}
+	return slot
+}
+
+// WritePiece stores a verified piece
+func (s *Storage) WritePiece(index int, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	start, end := s.torrent.pieceSpan(index)
+	partial := false
+	for i, f := range s.torrent.files() {
+		if f.offset >= end || f.offset+f.length <= start {
+			continue
+		}
+
+		if s.torrent.filePriority(i) == PrioritySkip {
+			partial = true
+			continue
+		}
+
+		err := s.writeFileSegment(f, start, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !partial {
+		return nil
+	}
+
+	slot := s.partsSlot(index)
+	err := s.writeAt(s.partsPath(), s.partsOffset(slot), data)
+	if err != nil {
+		return err
+	}
+	s.parts[index] = slot
+	s.slots[slot] = index
+	return nil
+}
+
+// ReadAt reads stored data at a torrent offset. p must not cross a piece boundary.
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pieceLength := int64(s.torrent.bencodeTorrent.Info.PieceLength)
+	index := int(off / pieceLength)
+	if slot, ok := s.parts[index]; ok {
+		err := s.readAt(s.partsPath(), s.partsOffset(slot)+off%pieceLength, p)
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	end := off + int64(len(p))
+	for _, f := range s.torrent.files() {
+		if f.offset >= end || f.offset+f.length <= off {
+			continue
+		}
+
+		from := max(f.offset, off)
+		to := min(f.offset+f.length, end)
+		err := s.readAt(filepath.Join(s.dir, f.path), from-f.offset, p[from-off:to-off])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// ApplyPriorities moves boundary data out of the parts file into files that
+// became wanted since the piece was written
+func (s *Storage) ApplyPriorities() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for index, slot := range s.parts {
+		start, end := s.torrent.pieceSpan(index)
+		data := make([]byte, end-start)
+		err := s.readAt(s.partsPath(), s.partsOffset(slot), data)
+		if err != nil {
+			return err
+		}
+
+		partial := false
+		for i, f := range s.torrent.files() {
+			if f.offset >= end || f.offset+f.length <= start {
+				continue
+			}
+
+			if s.torrent.filePriority(i) == PrioritySkip {
+				partial = true
+				continue
+			}
+
+			err = s.writeFileSegment(f, start, data)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !partial {
+			delete(s.parts, index)
+			s.slots[slot] = -1
+		}
+	}
+
+	if len(s.parts) == 0 {
+		s.slots = nil
+		err := os.Remove(s.partsPath())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileSegment writes the part of a piece starting at pieceStart that falls inside f
+func (s *Storage) writeFileSegment(f torrentFile, pieceStart int64, data []byte) error {
+	from := max(f.offset, pieceStart)
+	to := min(f.offset+f.length, pieceStart+int64(len(data)))
+	return s.writeAt(filepath.Join(s.dir, f.path), from-f.offset, data[from-pieceStart:to-pieceStart])
+}
+
+func (s *Storage) writeAt(path string, offset int64, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteAt(data, offset)
+	return err
+}
+
+func (s *Storage) readAt(path string, offset int64, data []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.ReadAt(data, offset)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Delete removes the torrent's files, its parts file and the directories
+// left empty. It never touches anything outside the torrent's own file or
+// directory in the download directory, other than the parts file.
+func (s *Storage) Delete() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	root := filepath.Join(s.dir, s.torrent.bencodeTorrent.Info.Name)
+	var paths []string
+	for _, f := range s.torrent.files() {
+		path := filepath.Join(s.dir, f.path)
+		if !withinDir(root, path) {
+			return fmt.Errorf("refusing to delete %s, outside %s", path, root)
+		}
+		paths = append(paths, path)
+	}
+
+	err := os.Remove(s.partsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// removing a non-empty directory fails, which stops the walk up
+		for dir := filepath.Dir(path); withinDir(root, dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	s.parts = make(map[int]int)
+	s.slots = nil
+	return nil
+}
+
+// withinDir tells if path is dir or lies under it
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
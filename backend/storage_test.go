@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPartsFile skips the middle file of a torrent whose pieces straddle the
+// files, so the two boundary pieces go to the parts file
+func TestPartsFile(t *testing.T) {
+	newTestSession(t)
+
+	const pieceLength = 16 << 10
+	root := filepath.Join(t.TempDir(), "boundary")
+	var data []byte
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		data = append(data, writeTestFile(t, filepath.Join(root, name), 20000)...)
+	}
+	torrent := addTestTorrent(t, root, pieceLength)
+	err := SetFilePriority(torrent.ID, 1, PrioritySkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStorage(torrent)
+	numPieces := torrent.bencodeTorrent.NumPieces()
+	for i := numPieces - 1; i >= 0; i-- {
+		start, end := torrent.pieceSpan(i)
+		err = s.WritePiece(i, data[start:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(DownloadDir, "boundary", "b.bin"))
+	if !os.IsNotExist(err) {
+		t.Error("the skipped file was created")
+	}
+	info, err := os.Stat(s.partsPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2*pieceLength {
+		t.Errorf("parts file holds %d bytes, want the 2 boundary pieces", info.Size())
+	}
+
+	// a new session finds the boundary pieces through the resume data
+	torrent.resumeParts = decodePartsIndex(encodePartsIndex(s.partsIndex()))
+	resumed := NewStorage(torrent)
+	for i := 0; i < numPieces; i++ {
+		start, end := torrent.pieceSpan(i)
+		got := make([]byte, end-start)
+		_, err = resumed.ReadAt(got, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data[start:end]) {
+			t.Errorf("piece %d read back differs", i)
+		}
+	}
+
+	// wanting the file again moves its data out of the parts file
+	torrent.mutex.Lock()
+	torrent.FilePriorities[1] = PriorityNormal
+	torrent.mutex.Unlock()
+	err = resumed.ApplyPriorities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(DownloadDir, "boundary", "b.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[20000:40000]) {
+		t.Error("b.bin differs from the data written")
+	}
+	_, err = os.Stat(resumed.partsPath())
+	if !os.IsNotExist(err) {
+		t.Error("the parts file wasn't removed once empty")
+	}
+
+	// torrents of the same name keep their own parts file
+	other := filepath.Join(t.TempDir(), "boundary")
+	writeTestFile(t, filepath.Join(other, "a.bin"), 20000)
+	if NewStorage(addTestTorrent(t, other, pieceLength)).partsPath() == s.partsPath() {
+		t.Error("torrents of the same name share a parts file")
+	}
+}
@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamAddr is where the streaming server listens. It's fixed so URLs handed
+// to media players stay valid across restarts.
+var StreamAddr = "127.0.0.1:9339"
+
+var (
+	streamURL      string
+	streamURLMutex sync.Mutex
+)
+
+// StartStreamServer serves the files of active torrents over HTTP at
+// /stream/<torrent id>/<file index>/<file name>, with range requests, so
+// media players can open them while they download
+func StartStreamServer() error {
+	listener, err := net.Listen("tcp", StreamAddr)
+	if err != nil {
+		return err
+	}
+
+	// not every system mime table knows these
+	mime.AddExtensionType(".mkv", "video/x-matroska")
+	mime.AddExtensionType(".srt", "application/x-subrip")
+
+	streamURLMutex.Lock()
+	streamURL = "http://" + listener.Addr().String()
+	streamURLMutex.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream/", handleStream)
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			fmt.Println("Stream server stopped:", err)
+		}
+	}()
+	return nil
+}
+
+// StreamURL returns the URL a file of a torrent is served at
+func StreamURL(torrentID, fileIndex int) (string, error) {
+	streamURLMutex.Lock()
+	base := streamURL
+	streamURLMutex.Unlock()
+	if base == "" {
+		return "", fmt.Errorf("stream server is not running")
+	}
+
+	t := GetTorrent(torrentID)
+	if t == nil {
+		return "", fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	if fileIndex < 0 || fileIndex >= len(t.FileNames) {
+		return "", fmt.Errorf("invalid file index %d", fileIndex)
+	}
+
+	return fmt.Sprintf("%s/stream/%d/%d/%s", base, torrentID, fileIndex, url.PathEscape(t.FileNames[fileIndex])), nil
+}
+
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// /stream/<torrent id>/<file index>[/<name>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/stream/"), "/", 3)
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	torrentID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	fileIndex, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	reader, err := OpenFile(torrentID, fileIndex)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+
+	// reads block until pieces arrive, so a player going away must unblock them
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			reader.Close()
+		case <-done:
+		}
+	}()
+
+	// start fetching around the requested range before the first read
+	start := rangeStart(r.Header.Get("Range"))
+	if start < reader.Size() {
+		reader.client.picker.SetReadPosition(reader.id, reader.pieceAt(start))
+	}
+
+	name := path.Base(reader.file.path)
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
+
+// rangeStart returns the first byte of a "bytes=<start>-" header, or 0
+func rangeStart(header string) int64 {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0
+	}
+
+	first, _, _ := strings.Cut(spec, ",")
+	from, _, _ := strings.Cut(first, "-")
+	start, err := strconv.ParseInt(strings.TrimSpace(from), 10, 64)
+	if err != nil || start < 0 {
+		return 0
+	}
+	return start
+}
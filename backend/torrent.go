@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -13,14 +14,18 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
 type BencodeTorrent struct {
-	Announce   string      `bencode:"announce" json:"announce"`
-	Info       bencodeInfo `bencode:"info" json:"info"`
-	havePieces Bitfield
+	Announce string      `bencode:"announce" json:"announce"`
+	Info     bencodeInfo `bencode:"info" json:"info"`
+	// webSeeds are the url-list HTTP mirrors of the data (BEP 19)
+	webSeeds []string `bencode:"-"`
 }
 
 func (bT *BencodeTorrent) VerifyPiece(index uint32, data []byte) bool {
@@ -34,14 +39,10 @@ func (bT *BencodeTorrent) VerifyPiece(index uint32, data []byte) bool {
 	return bytes.Equal(hash, []byte(bT.Info.Pieces[start:end]))
 }
 
+// hash is the info hash, taken over the info dictionary exactly as the
+// .torrent file has it so keys we don't decode still count
 func (bI *bencodeInfo) hash() [20]byte {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *bI)
-	if err != nil {
-		panic(err)
-	}
-	h := sha1.Sum(buf.Bytes())
-	return h
+	return bI.infoHash
 }
 
 func (bT *BencodeTorrent) NumPieces() int {
@@ -55,6 +56,12 @@ type bencodeInfo struct {
 	Length      int        `bencode:"length" json:"-"`
 	Name        string     `bencode:"name" json:"name"`
 	Files       []fileInfo `bencode:"files" json:"-"`
+	// Private is 1 for torrents limited to their trackers' peers (BEP 27)
+	Private  int      `bencode:"private,omitempty" json:"-"`
+	infoHash [20]byte `bencode:"-"`
+	// raw is the info dictionary as the .torrent file has it, which is what
+	// peers fetching the metadata of a magnet link get (BEP 9)
+	raw []byte `bencode:"-"`
 }
 
 type fileInfo struct {
@@ -71,7 +78,32 @@ type Torrent struct {
 	IsMultiFile    bool            `json:"isMultiFile"`
 	TotalLength    int64           `json:"totalLength"`
 	Status         string          `json:"status"`
+	FilePriorities []FilePriority  `json:"filePriorities"`
+	Sequential     bool            `json:"sequential"`
+	DownloadLimit  int64           `json:"downloadLimit"`
+	UploadLimit    int64           `json:"uploadLimit"`
+	QueuePosition  int             `json:"queuePosition"`
+	Uploaded       int64           `json:"uploaded"`
+	Downloaded     int64           `json:"downloaded"`
+	Ratio          float64         `json:"ratio"`
+	SeedingTime    int64           `json:"seedingTime"` // seconds
+	SeedingGoals   *SeedingGoals   `json:"seedingGoals"`
+	Private        bool            `json:"private"` // BEP 27, tracker peers only
 	bencodeTorrent *BencodeTorrent `json:"-"`
+	// metainfo is the raw .torrent file, kept to resume the torrent on restart
+	metainfo []byte
+	// resumeParts is the piece in each slot of the parts file the last
+	// session left, -1 for a free slot
+	resumeParts []int
+	// magnetPeers are the peers found while fetching the metadata of a
+	// magnet link, until the torrent's client takes them
+	magnetPeers []*Peer
+	// mutex guards the fields that change while the torrent is loaded:
+	// Status, Progress, Ratio, FilePriorities, Sequential, the limits,
+	// QueuePosition, SeedingGoals and magnetPeers. Status and QueuePosition
+	// are also written with queueMutex held. The transfer counters are
+	// atomic.
+	mutex sync.Mutex
 }
 
 type TrackerResponse struct {
@@ -83,6 +115,31 @@ type TrackerResponse struct {
 	Complete       int    `bencode:"complete"`
 	Incomplete     int    `bencode:"incomplete"`
 	Peers          string `bencode:"peers"`
+	Peers6         string `bencode:"peers6,omitempty"`
+}
+
+var (
+	torrents      = make(map[int]*Torrent)
+	torrentsMutex sync.Mutex
+)
+
+// GetTorrent returns a torrent loaded in this session by its database id
+func GetTorrent(id int) *Torrent {
+	torrentsMutex.Lock()
+	defer torrentsMutex.Unlock()
+	return torrents[id]
+}
+
+func registerTorrent(t *Torrent) {
+	torrentsMutex.Lock()
+	defer torrentsMutex.Unlock()
+	torrents[t.ID] = t
+}
+
+func unregisterTorrent(id int) {
+	torrentsMutex.Lock()
+	defer torrentsMutex.Unlock()
+	delete(torrents, id)
 }
 
 func NewTorrent(bt *BencodeTorrent) *Torrent {
@@ -96,6 +153,7 @@ func (t *Torrent) initFromBencode(bt *BencodeTorrent) {
 	t.bencodeTorrent = bt
 	t.TorrentName = bt.Info.Name
 	t.IsMultiFile = len(bt.Info.Files) > 0
+	t.Private = bt.Info.Private == 1
 
 	if t.IsMultiFile {
 		t.TotalLength = 0
@@ -107,68 +165,410 @@ func (t *Torrent) initFromBencode(bt *BencodeTorrent) {
 		t.FileNames = []string{bt.Info.Name}
 		t.TotalLength = int64(bt.Info.Length)
 	}
+
+	t.FilePriorities = make([]FilePriority, len(t.FileNames))
+	for i := range t.FilePriorities {
+		t.FilePriorities[i] = PriorityNormal
+	}
 }
 
 func HandleFile(ctx context.Context, path string) (*Torrent, error) {
-	f, err := os.Open(path)
+	metainfo, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	r := bufio.NewReader(f)
-	bcode, err := getBencode(r)
+	t, _, err := AddMetainfo(metainfo)
+	return t, err
+}
+
+// HandleURL downloads a .torrent file and adds it
+func HandleURL(ctx context.Context, torrentURL string) (*Torrent, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, torrentURL, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("fetching %s: %s", torrentURL, resp.Status)
+	}
+
+	metainfo, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return AddMetainfo(metainfo)
+}
+
+// AddMetainfo adds a torrent from the contents of a .torrent file. Adding a
+// torrent twice gives back the one already loaded, reported as a duplicate.
+func AddMetainfo(metainfo []byte) (*Torrent, bool, error) {
+	bcode, err := getBencode(bufio.NewReader(bytes.NewReader(metainfo)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if t := findTorrent(bcode.Info.hash()); t != nil {
+		return t, true, nil
 	}
 
-	// readTorrentFile(ctx, bcode)
 	t := NewTorrent(bcode)
+	t.metainfo = metainfo
 	Insert(t)
-	return t, nil
+
+	err = loadFilePriorities(t)
+	if err != nil {
+		return nil, false, err
+	}
+
+	registerTorrent(t)
+	return t, false, nil
+}
+
+// Snapshot returns a copy of the torrent that's safe to read and encode
+// while the torrent runs
+func (t *Torrent) Snapshot() *Torrent {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return &Torrent{
+		ID:             t.ID,
+		TorrentName:    t.TorrentName,
+		FileNames:      t.FileNames,
+		Progress:       t.Progress,
+		IsMultiFile:    t.IsMultiFile,
+		TotalLength:    t.TotalLength,
+		Status:         t.Status,
+		FilePriorities: append([]FilePriority(nil), t.FilePriorities...),
+		Sequential:     t.Sequential,
+		DownloadLimit:  t.DownloadLimit,
+		UploadLimit:    t.UploadLimit,
+		QueuePosition:  t.QueuePosition,
+		Uploaded:       atomic.LoadInt64(&t.Uploaded),
+		Downloaded:     atomic.LoadInt64(&t.Downloaded),
+		Ratio:          t.Ratio,
+		SeedingTime:    atomic.LoadInt64(&t.SeedingTime),
+		SeedingGoals:   t.SeedingGoals,
+		Private:        t.Private,
+		bencodeTorrent: t.bencodeTorrent,
+		metainfo:       t.metainfo,
+	}
+}
+
+// status returns the queue status of the torrent
+func (t *Torrent) status() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.Status
+}
+
+// filePriority returns the priority of file i
+func (t *Torrent) filePriority(i int) FilePriority {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.FilePriorities[i]
+}
+
+// InfoHash returns the hex info hash of the torrent
+func (t *Torrent) InfoHash() string {
+	h := t.bencodeTorrent.Info.hash()
+	return hex.EncodeToString(h[:])
+}
+
+// LoadedTorrents returns the torrents of this session in queue order
+func LoadedTorrents() []*Torrent {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	return queueOrder()
+}
+
+// findTorrent returns the loaded torrent with the given info hash, if any
+func findTorrent(infoHash [20]byte) *Torrent {
+	torrentsMutex.Lock()
+	defer torrentsMutex.Unlock()
+
+	for _, t := range torrents {
+		if t.bencodeTorrent != nil && t.bencodeTorrent.Info.hash() == infoHash {
+			return t
+		}
+	}
+	return nil
+}
+
+const (
+	// defaultAnnounceInterval is used when the tracker doesn't give one
+	defaultAnnounceInterval = 30 * time.Minute
+	// minAnnounceInterval keeps a misconfigured tracker from being hammered
+	minAnnounceInterval = time.Minute
+)
+
+// runTracker announces the torrent until ctx is done: started once the
+// announces of the previous run are over, completed when the download
+// finishes and regular announces on the tracker's interval in between,
+// each one refilling the pool. Failed announces are retried with backoff.
+// Once stopped it tells the tracker we left, then closes done.
+func (c *Client) runTracker(ctx context.Context, prev <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if prev != nil {
+		<-prev
+	}
+	if c.Torrent.bencodeTorrent.Announce == "" {
+		return
+	}
+
+	event := "started"
+	started := false
+	var backoff time.Duration
+	for {
+		wait := defaultAnnounceInterval
+		tr, err := announce(ctx, c, event)
+		if err == nil {
+			started = true
+			event = ""
+			backoff = 0
+			wait = c.addTrackerPeers(tr)
+		} else if ctx.Err() == nil {
+			backoff = min(max(backoff*2, retryBackoff), maxRetryBackoff)
+			wait = backoff
+			fmt.Printf("Error announcing to tracker, retrying in %s: %v\n", wait, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if started {
+				c.announceStopped()
+			}
+			return
+		case <-c.trackerCompleted:
+			// a tracker that never saw us start learns we're done from left
+			if started {
+				event = "completed"
+			}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// addTrackerPeers hands the peers of a tracker response to the pool and
+// returns how long to wait before the next announce
+func (c *Client) addTrackerPeers(tr *TrackerResponse) time.Duration {
+	c.trackerSeeds.Store(int64(tr.Complete))
+	c.trackerLeechers.Store(int64(tr.Incomplete))
+
+	peers, err := parseCompactPeers(tr.Peers, net.IPv4len)
+	if err != nil {
+		fmt.Println("Error parsing peers:", err)
+	}
+	peers6, err := parseCompactPeers(tr.Peers6, net.IPv6len)
+	if err != nil {
+		fmt.Println("Error parsing IPv6 peers:", err)
+	}
+	c.addCandidates(append(peers, peers6...))
+
+	interval := time.Duration(max(tr.Interval, tr.MinInterval)) * time.Second
+	if interval == 0 {
+		interval = defaultAnnounceInterval
+	}
+	return max(interval, minAnnounceInterval)
 }
 
-func readTorrentFile(ctx context.Context, bcode *BencodeTorrent) {
-	str := "-TX0001-7478636c636b"
+// announceStopped tells the tracker we left, giving up after
+// stoppedAnnounceTimeout
+func (c *Client) announceStopped() {
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
 
-	var peerID [20]byte
-	copy(peerID[:], str)
+	_, err := announce(ctx, c, "stopped")
+	if err != nil {
+		fmt.Printf("Error announcing stop of %s: %v\n", c.Torrent.TorrentName, err)
+	}
+}
 
-	trackerUrl, err := getTrackerURL(bcode, str)
+// waitTracker returns once a stopped client is done with its tracker
+func (c *Client) waitTracker() {
+	c.mutex.Lock()
+	done := c.trackerDone
+	c.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// announce tells the tracker how the torrent is going. event is "started",
+// "completed", "stopped" or empty for regular announces.
+func announce(ctx context.Context, cl *Client, event string) (*TrackerResponse, error) {
+	tr, err := sendAnnounce(ctx, cl, event)
 	if err != nil {
-		panic(err)
+		publish(Event{Type: EventTrackerError, TorrentID: cl.Torrent.ID, Data: TrackerErrorEvent{
+			Announce: cl.Torrent.bencodeTorrent.Announce,
+			Error:    err.Error(),
+		}})
 	}
+	return tr, err
+}
 
-	resp, err := http.Get(trackerUrl)
+func sendAnnounce(ctx context.Context, cl *Client, event string) (*TrackerResponse, error) {
+	t := cl.Torrent
+	trackerUrl, err := getTrackerURL(t.bencodeTorrent, cl.announceKey, atomic.LoadInt64(&t.Uploaded),
+		atomic.LoadInt64(&t.Downloaded), cl.Left(), event)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return requestTracker(ctx, trackerUrl)
+}
 
-	tr, err := getTracker(resp.Body)
+// requestTracker sends an announce and decodes the tracker's response
+func requestTracker(ctx context.Context, trackerUrl string) (*TrackerResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerUrl, nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	peers, err := parseBinaryPeers(tr.Peers)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	for _, peer := range peers {
-		go ConnectToPeer(ctx, peer, bcode.Info.hash(), peerID)
+	tr, err := getTracker(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
+	if tr.FailureReason != "" {
+		return nil, fmt.Errorf("tracker failure: %s", tr.FailureReason)
+	}
+	return tr, nil
 }
 
 func getBencode(r io.Reader) (*BencodeTorrent, error) {
+	metainfo, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
 	bto := BencodeTorrent{}
-	err := bencode.Unmarshal(r, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(metainfo), &bto)
+	if err != nil {
+		return nil, err
+	}
+	err = bto.Info.checkPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := rawValue(metainfo, "info")
 	if err != nil {
 		return nil, err
 	}
+	if info == nil {
+		return nil, fmt.Errorf("metainfo has no info dictionary")
+	}
+	bto.Info.infoHash = sha1.Sum(info)
+	bto.Info.raw = info
+
+	// url-list is a single URL or a list of them, which the decoder can't
+	// put in one field
+	urlList, err := rawValue(metainfo, "url-list")
+	if err != nil {
+		return nil, err
+	}
+	if urlList != nil {
+		v, err := bencode.Decode(bytes.NewReader(urlList))
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case string:
+			bto.webSeeds = []string{v}
+		case []interface{}:
+			for _, u := range v {
+				if u, ok := u.(string); ok && u != "" {
+					bto.webSeeds = append(bto.webSeeds, u)
+				}
+			}
+		}
+	}
 	return &bto, nil
 }
 
+// rawValue returns the value of key in a bencoded dictionary as it's
+// encoded, nil if the key is missing
+func rawValue(dict []byte, key string) ([]byte, error) {
+	if len(dict) == 0 || dict[0] != 'd' {
+		return nil, fmt.Errorf("not a bencoded dictionary")
+	}
+
+	want := strconv.Itoa(len(key)) + ":" + key
+	i := 1
+	for i < len(dict) && dict[i] != 'e' {
+		keyEnd, err := bencodeEnd(dict, i)
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := bencodeEnd(dict, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if string(dict[i:keyEnd]) == want {
+			return dict[keyEnd:valueEnd], nil
+		}
+		i = valueEnd
+	}
+	return nil, nil
+}
+
+// bencodeEnd returns the offset just past the bencoded value starting at i
+func bencodeEnd(b []byte, i int) (int, error) {
+	if i >= len(b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	switch c := b[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(b[i:], 'e')
+		if end < 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(b) && b[i] != 'e' {
+			var err error
+			i, err = bencodeEnd(b, i)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(b) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b[i:], ':')
+		if colon < 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n, err := strconv.Atoi(string(b[i : i+colon]))
+		if err != nil {
+			return 0, err
+		}
+		end := i + colon + 1 + n
+		if end > len(b) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return end, nil
+	}
+	return 0, fmt.Errorf("invalid bencode at offset %d", i)
+}
+
 func getTracker(r io.Reader) (*TrackerResponse, error) {
 	bto := TrackerResponse{}
 	err := bencode.Unmarshal(r, &bto)
@@ -178,7 +578,7 @@ func getTracker(r io.Reader) (*TrackerResponse, error) {
 	return &bto, nil
 }
 
-func getTrackerURL(b *BencodeTorrent, peerID string) (string, error) {
+func getTrackerURL(b *BencodeTorrent, key string, uploaded, downloaded, left int64, event string) (string, error) {
 	base, err := url.Parse(b.Announce)
 	if err != nil {
 		return "", err
@@ -187,29 +587,44 @@ func getTrackerURL(b *BencodeTorrent, peerID string) (string, error) {
 	infoHash := b.Info.hash()
 	params := url.Values{
 		"info_hash":  []string{string(infoHash[:])},
-		"peer_id":    []string{peerID[:]},
-		"port":       []string{base.Port()},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"peer_id":    []string{string(peerID[:])},
+		"key":        []string{key},
+		"port":       []string{strconv.Itoa(ListenPort)},
+		"uploaded":   []string{strconv.FormatInt(uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(b.Info.Length)},
+		"left":       []string{strconv.FormatInt(left, 10)},
+	}
+	if event != "" {
+		params.Set("event", event)
+	}
+
+	// lets trackers give out both our addresses, whichever we announce from
+	ipv4, ipv6 := localAddresses()
+	if ipv4 != "" {
+		params.Set("ipv4", ipv4)
+	}
+	if ipv6 != "" {
+		params.Set("ipv6", ipv6)
 	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func parseBinaryPeers(data string) ([]*Peer, error) {
-	const peerSize = 6 // 4 bytes for IP and 2 bytes for port
+// parseCompactPeers decodes the compact peer format used by trackers, PEX
+// and DHT: an IP of ipLen bytes followed by a 2 byte port, for each peer
+func parseCompactPeers(data string, ipLen int) ([]*Peer, error) {
+	peerSize := ipLen + 2
 	bytesData := []byte(data)
 
 	if len(bytesData)%peerSize != 0 {
-		return nil, fmt.Errorf("invalid binary peers length")
+		return nil, fmt.Errorf("invalid compact peers length %d", len(bytesData))
 	}
 
 	var peers []*Peer
 	for i := 0; i < len(bytesData); i += peerSize {
-		ip := net.IP(bytesData[i : i+4]).String()
-		port := binary.BigEndian.Uint16(bytesData[i+4 : i+6])
+		ip := net.IP(bytesData[i : i+ipLen]).String()
+		port := binary.BigEndian.Uint16(bytesData[i+ipLen : i+peerSize])
 		peers = append(peers, &Peer{
 			IP:               ip,
 			Port:             strconv.Itoa(int(port)),
@@ -217,6 +632,8 @@ func parseBinaryPeers(data string) ([]*Peer, error) {
 			ClientInterested: false,
 			ClientChoked:     true,
 			PeerInterested:   false,
+			Direction:        PeerOutgoing,
+			Source:           PeerSourceTracker,
 		})
 	}
 
@@ -0,0 +1,648 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Transmission RPC (https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md),
+// enough of it for tremc, Sonarr/Radarr and scripts to drive gorrent.
+
+// SocketPath is the unix socket gorrentd listens on for the gorrent CLI
+var SocketPath = filepath.Join(os.TempDir(), "gorrentd.sock")
+
+const (
+	transmissionRPCPath    = "/transmission/rpc"
+	transmissionSessionKey = "X-Transmission-Session-Id"
+	transmissionRPCVersion = 17
+	// speeds are exchanged in kB/s
+	transmissionSpeedUnit = 1000
+)
+
+// transmission torrent status codes
+const (
+	trStatusStopped      = 0
+	trStatusDownloadWait = 3
+	trStatusDownload     = 4
+	trStatusSeedWait     = 5
+	trStatusSeed         = 6
+)
+
+type transmissionRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       *int            `json:"tag,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       *int        `json:"tag,omitempty"`
+}
+
+// TransmissionHandler serves the Transmission RPC protocol. Requests need the
+// session id handed out in a 409 response, and basic auth when a username is set.
+type TransmissionHandler struct {
+	Username  string
+	Password  string
+	sessionID string
+}
+
+func NewTransmissionHandler(username, password string) *TransmissionHandler {
+	id := make([]byte, 24)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+
+	return &TransmissionHandler{
+		Username:  username,
+		Password:  password,
+		sessionID: hex.EncodeToString(id),
+	}
+}
+
+// DefaultRPCAddr is where the Transmission RPC listens when no address is given
+const DefaultRPCAddr = "127.0.0.1:9091"
+
+// StartTransmissionRPC serves the Transmission RPC on addr, DefaultRPCAddr
+// if it's empty
+func StartTransmissionRPC(addr, username, password string) error {
+	if addr == "" {
+		addr = DefaultRPCAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle(transmissionRPCPath, NewTransmissionHandler(username, password))
+	return serveInBackground(addr, mux, "Transmission RPC", username)
+}
+
+// StartControlSocket serves the Transmission RPC on a unix socket for the
+// gorrent CLI. The socket is only accessible to the current user, so there's
+// no authentication.
+func StartControlSocket(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(transmissionRPCPath, NewTransmissionHandler("", ""))
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			fmt.Println("Control socket stopped:", err)
+		}
+	}()
+	return nil
+}
+
+func (h *TransmissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Username != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || !equalSecret(username, h.Username) || !equalSecret(password, h.Password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// CSRF protection: clients must echo the session id back
+	w.Header().Set(transmissionSessionKey, h.sessionID)
+	if r.Header.Get(transmissionSessionKey) != h.sessionID {
+		http.Error(w, "invalid session id", http.StatusConflict)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req transmissionRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	args, err := h.call(r.Context(), req)
+	resp := transmissionResponse{Result: "success", Arguments: args, Tag: req.Tag}
+	if err != nil {
+		resp.Result = err.Error()
+		resp.Arguments = struct{}{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *TransmissionHandler) call(ctx context.Context, req transmissionRequest) (interface{}, error) {
+	var args map[string]json.RawMessage
+	if len(req.Arguments) > 0 {
+		err := json.Unmarshal(req.Arguments, &args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arguments")
+		}
+	}
+
+	switch req.Method {
+	case "torrent-add":
+		return transmissionAdd(ctx, args)
+	case "torrent-get":
+		return transmissionGet(args)
+	case "torrent-start", "torrent-start-now":
+		return transmissionEach(args, ResumeTorrent)
+	case "torrent-stop":
+		return transmissionEach(args, PauseTorrent)
+	case "torrent-verify":
+		return transmissionEach(args, VerifyTorrent)
+	case "torrent-remove":
+		var deleteData bool
+		decodeArg(args, "delete-local-data", &deleteData)
+		return transmissionEach(args, func(id int) error {
+			RemoveTorrent(id, deleteData)
+			return nil
+		})
+	case "session-get":
+		return h.sessionGet(), nil
+	case "session-set":
+		return struct{}{}, transmissionSessionSet(args)
+	case "session-stats":
+		return transmissionStats(), nil
+	default:
+		return nil, fmt.Errorf("method name not recognized")
+	}
+}
+
+func transmissionAdd(ctx context.Context, args map[string]json.RawMessage) (interface{}, error) {
+	var filename, metainfo string
+	var paused bool
+	decodeArg(args, "filename", &filename)
+	decodeArg(args, "metainfo", &metainfo)
+	decodeArg(args, "paused", &paused)
+
+	var t *Torrent
+	var duplicate bool
+	var err error
+	switch {
+	case metainfo != "":
+		var data []byte
+		data, err = base64.StdEncoding.DecodeString(metainfo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metainfo")
+		}
+		t, duplicate, err = AddMetainfo(data)
+	case strings.HasPrefix(filename, "magnet:"):
+		t, duplicate, err = HandleMagnet(ctx, filename)
+	case strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://"):
+		t, duplicate, err = HandleURL(ctx, filename)
+	case filename != "":
+		var data []byte
+		data, err = os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		t, duplicate, err = AddMetainfo(data)
+	default:
+		return nil, fmt.Errorf("no filename or metainfo given")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	added := map[string]interface{}{
+		"id":         t.ID,
+		"name":       t.TorrentName,
+		"hashString": t.InfoHash(),
+	}
+	if duplicate {
+		return map[string]interface{}{"torrent-duplicate": added}, nil
+	}
+
+	if paused {
+		EnqueuePaused(t)
+	} else {
+		Enqueue(t)
+	}
+	return map[string]interface{}{"torrent-added": added}, nil
+}
+
+func transmissionGet(args map[string]json.RawMessage) (interface{}, error) {
+	var fields []string
+	decodeArg(args, "fields", &fields)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields given")
+	}
+
+	selected, err := transmissionTorrents(args)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]map[string]interface{}, 0, len(selected))
+	for _, t := range selected {
+		cl := GetClient(t.ID)
+		if cl == nil {
+			continue
+		}
+
+		item := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			value, ok := transmissionField(cl, field)
+			if ok {
+				item[field] = value
+			}
+		}
+		list = append(list, item)
+	}
+	return map[string]interface{}{"torrents": list}, nil
+}
+
+// transmissionField returns a torrent-get field, false for fields we don't know
+func transmissionField(cl *Client, field string) (interface{}, bool) {
+	t := cl.Torrent.Snapshot()
+	switch field {
+	case "id":
+		return t.ID, true
+	case "name":
+		return t.TorrentName, true
+	case "hashString":
+		return t.InfoHash(), true
+	case "isPrivate":
+		return t.Private, true
+	case "status":
+		return transmissionStatus(cl), true
+	case "totalSize":
+		return t.TotalLength, true
+	case "sizeWhenDone":
+		return cl.Completed() + cl.Left(), true
+	case "leftUntilDone":
+		return cl.Left(), true
+	case "haveValid":
+		return cl.Completed(), true
+	case "percentDone":
+		wanted := cl.Completed() + cl.Left()
+		if wanted == 0 {
+			return 1.0, true
+		}
+		return float64(cl.Completed()) / float64(wanted), true
+	case "isFinished":
+		return cl.Complete(), true
+	case "rateDownload":
+		return torrentStats(t.ID).DownloadSpeed, true
+	case "rateUpload":
+		return torrentStats(t.ID).UploadSpeed, true
+	case "error":
+		return 0, true
+	case "errorString":
+		return "", true
+	case "eta":
+		// -1 is Transmission's "not available"
+		speed, left := torrentStats(t.ID).DownloadSpeed, cl.Left()
+		if left == 0 || speed == 0 {
+			return -1, true
+		}
+		return left / speed, true
+	case "uploadedEver":
+		return atomic.LoadInt64(&t.Uploaded), true
+	case "downloadedEver":
+		return atomic.LoadInt64(&t.Downloaded), true
+	case "uploadRatio":
+		return t.ShareRatio(), true
+	case "secondsSeeding":
+		return atomic.LoadInt64(&t.SeedingTime), true
+	case "queuePosition":
+		return t.QueuePosition, true
+	case "downloadDir":
+		return cl.storage.dir, true
+	case "peersConnected":
+		return cl.PeerCount(), true
+	case "sequentialDownload":
+		return t.Sequential, true
+	case "files":
+		files := make([]map[string]interface{}, 0, len(t.FileNames))
+		for i, f := range t.files() {
+			files = append(files, map[string]interface{}{
+				"name":           f.path,
+				"length":         f.length,
+				"bytesCompleted": cl.FileCompleted(i),
+			})
+		}
+		return files, true
+	case "fileStats":
+		stats := make([]map[string]interface{}, 0, len(t.FileNames))
+		for i, priority := range t.FilePriorities {
+			stats = append(stats, map[string]interface{}{
+				"bytesCompleted": cl.FileCompleted(i),
+				"wanted":         priority != PrioritySkip,
+				"priority":       transmissionPriority(priority),
+			})
+		}
+		return stats, true
+	case "wanted":
+		wanted := make([]bool, len(t.FilePriorities))
+		for i, priority := range t.FilePriorities {
+			wanted[i] = priority != PrioritySkip
+		}
+		return wanted, true
+	case "priorities":
+		priorities := make([]int, len(t.FilePriorities))
+		for i, priority := range t.FilePriorities {
+			priorities[i] = transmissionPriority(priority)
+		}
+		return priorities, true
+	}
+	return nil, false
+}
+
+func transmissionStatus(cl *Client) int {
+	switch cl.Torrent.status() {
+	case StatusDownloading:
+		return trStatusDownload
+	case StatusSeeding:
+		return trStatusSeed
+	case StatusQueued:
+		if cl.Complete() {
+			return trStatusSeedWait
+		}
+		return trStatusDownloadWait
+	default:
+		return trStatusStopped
+	}
+}
+
+// transmissionPriority maps our priorities to low (-1), normal (0) and high (1)
+func transmissionPriority(priority FilePriority) int {
+	switch priority {
+	case PriorityHigh:
+		return 1
+	case PriorityLow:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// transmissionTorrents resolves the "ids" argument: a single id, a list of
+// ids and hash strings, "recently-active", or every torrent when missing
+func transmissionTorrents(args map[string]json.RawMessage) ([]*Torrent, error) {
+	all := LoadedTorrents()
+	raw, ok := args["ids"]
+	if !ok {
+		return all, nil
+	}
+
+	var id int
+	if json.Unmarshal(raw, &id) == nil {
+		if t := GetTorrent(id); t != nil {
+			return []*Torrent{t}, nil
+		}
+		return nil, nil
+	}
+
+	var keyword string
+	if json.Unmarshal(raw, &keyword) == nil {
+		if keyword == "recently-active" {
+			return all, nil
+		}
+		return nil, fmt.Errorf("invalid ids")
+	}
+
+	var ids []interface{}
+	err := json.Unmarshal(raw, &ids)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ids")
+	}
+
+	var selected []*Torrent
+	for _, t := range all {
+		for _, id := range ids {
+			switch id := id.(type) {
+			case float64:
+				if int(id) == t.ID {
+					selected = append(selected, t)
+				}
+			case string:
+				if strings.EqualFold(id, t.InfoHash()) {
+					selected = append(selected, t)
+				}
+			}
+		}
+	}
+	return selected, nil
+}
+
+func transmissionEach(args map[string]json.RawMessage, action func(id int) error) (interface{}, error) {
+	selected, err := transmissionTorrents(args)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range selected {
+		err = action(t.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return struct{}{}, nil
+}
+
+// transmissionEncryption maps our encryption policies to Transmission's names
+var transmissionEncryption = map[string]string{
+	EncryptionPrefer:   "preferred",
+	EncryptionRequire:  "required",
+	EncryptionTolerate: "tolerated",
+}
+
+// transmissionEncryptionName is the Transmission name of the policy.
+// Transmission has no plaintext only mode, so disabled shows as the
+// closest, tolerated.
+func transmissionEncryptionName(policy string) string {
+	if policy == EncryptionDisabled {
+		return transmissionEncryption[EncryptionTolerate]
+	}
+	return transmissionEncryption[policy]
+}
+
+func (h *TransmissionHandler) sessionGet() map[string]interface{} {
+	bandwidth := GetBandwidthSettings()
+	queue := GetQueueSettings()
+	goals := GetSeedingGoals()
+	connections := GetConnectionSettings()
+
+	return map[string]interface{}{
+		"version":                    "2.94 (gorrent)",
+		"rpc-version":                transmissionRPCVersion,
+		"rpc-version-minimum":        14,
+		"session-id":                 h.sessionID,
+		"download-dir":               DownloadDir,
+		"speed-limit-down":           bandwidth.DownloadLimit / transmissionSpeedUnit,
+		"speed-limit-down-enabled":   bandwidth.DownloadLimit > 0,
+		"speed-limit-up":             bandwidth.UploadLimit / transmissionSpeedUnit,
+		"speed-limit-up-enabled":     bandwidth.UploadLimit > 0,
+		"alt-speed-down":             bandwidth.AltDownloadLimit / transmissionSpeedUnit,
+		"alt-speed-up":               bandwidth.AltUploadLimit / transmissionSpeedUnit,
+		"alt-speed-enabled":          bandwidth.AltEnabled,
+		"alt-speed-time-enabled":     bandwidth.AltScheduleEnabled,
+		"alt-speed-time-begin":       bandwidth.AltFrom * 60,
+		"alt-speed-time-end":         bandwidth.AltTo * 60,
+		"download-queue-enabled":     queue.MaxActiveDownloads > 0,
+		"download-queue-size":        queue.MaxActiveDownloads,
+		"seed-queue-enabled":         queue.MaxActiveSeeds > 0,
+		"seed-queue-size":            queue.MaxActiveSeeds,
+		"seedRatioLimited":           goals.Ratio > 0,
+		"seedRatioLimit":             goals.Ratio,
+		"idle-seeding-limit-enabled": goals.IdleTime > 0,
+		"idle-seeding-limit":         goals.IdleTime,
+		"encryption":                 transmissionEncryptionName(GetEncryptionPolicy()),
+		"peer-limit-global":          connections.MaxConnections,
+		"peer-limit-per-torrent":     connections.MaxConnectionsPerTorrent,
+		"units": map[string]interface{}{
+			"speed-bytes":  transmissionSpeedUnit,
+			"size-bytes":   1000,
+			"memory-bytes": 1024,
+		},
+	}
+}
+
+// transmissionSessionSet applies the session-set keys we support. Disabling
+// a normal speed limit sets it to 0, our unlimited, while alt-speed-enabled
+// only switches the alternative limits on or off.
+func transmissionSessionSet(args map[string]json.RawMessage) error {
+	bandwidth := GetBandwidthSettings()
+	speedLimit := func(key, enabledKey string, limit *int64) {
+		var kbps int64
+		if decodeArg(args, key, &kbps) {
+			*limit = kbps * transmissionSpeedUnit
+		}
+		var enabled bool
+		if decodeArg(args, enabledKey, &enabled) && !enabled {
+			*limit = 0
+		}
+	}
+	speedLimit("speed-limit-down", "speed-limit-down-enabled", &bandwidth.DownloadLimit)
+	speedLimit("speed-limit-up", "speed-limit-up-enabled", &bandwidth.UploadLimit)
+	var kbps int64
+	if decodeArg(args, "alt-speed-down", &kbps) {
+		bandwidth.AltDownloadLimit = kbps * transmissionSpeedUnit
+	}
+	if decodeArg(args, "alt-speed-up", &kbps) {
+		bandwidth.AltUploadLimit = kbps * transmissionSpeedUnit
+	}
+	decodeArg(args, "alt-speed-enabled", &bandwidth.AltEnabled)
+	decodeArg(args, "alt-speed-time-enabled", &bandwidth.AltScheduleEnabled)
+
+	var minutes int
+	if decodeArg(args, "alt-speed-time-begin", &minutes) {
+		bandwidth.AltFrom = minutes / 60
+	}
+	if decodeArg(args, "alt-speed-time-end", &minutes) {
+		bandwidth.AltTo = minutes / 60
+	}
+
+	err := SetBandwidthSettings(bandwidth)
+	if err != nil {
+		return err
+	}
+
+	queue := GetQueueSettings()
+	decodeArg(args, "download-queue-size", &queue.MaxActiveDownloads)
+	decodeArg(args, "seed-queue-size", &queue.MaxActiveSeeds)
+	var enabled bool
+	if decodeArg(args, "download-queue-enabled", &enabled) && !enabled {
+		queue.MaxActiveDownloads = 0
+	}
+	if decodeArg(args, "seed-queue-enabled", &enabled) && !enabled {
+		queue.MaxActiveSeeds = 0
+	}
+
+	err = SetQueueSettings(queue)
+	if err != nil {
+		return err
+	}
+
+	connections := GetConnectionSettings()
+	decodeArg(args, "peer-limit-global", &connections.MaxConnections)
+	decodeArg(args, "peer-limit-per-torrent", &connections.MaxConnectionsPerTorrent)
+	err = SetConnectionSettings(connections)
+	if err != nil {
+		return err
+	}
+
+	var encryption string
+	if decodeArg(args, "encryption", &encryption) {
+		for policy, name := range transmissionEncryption {
+			if name == encryption {
+				err = SetEncryptionPolicy(policy)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	goals := GetSeedingGoals()
+	decodeArg(args, "seedRatioLimit", &goals.Ratio)
+	decodeArg(args, "idle-seeding-limit", &goals.IdleTime)
+	if decodeArg(args, "seedRatioLimited", &enabled) && !enabled {
+		goals.Ratio = 0
+	}
+	if decodeArg(args, "idle-seeding-limit-enabled", &enabled) && !enabled {
+		goals.IdleTime = 0
+	}
+	return SetSeedingGoals(goals)
+}
+
+func transmissionStats() map[string]interface{} {
+	all := LoadedTorrents()
+	active := 0
+	for _, t := range all {
+		if status := t.status(); status == StatusDownloading || status == StatusSeeding {
+			active++
+		}
+	}
+
+	download, upload := totalSpeeds()
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": len(all) - active,
+		"torrentCount":       len(all),
+		"downloadSpeed":      download,
+		"uploadSpeed":        upload,
+	}
+}
+
+// decodeArg decodes an argument into v, telling if it was present and valid
+func decodeArg(args map[string]json.RawMessage, key string, v interface{}) bool {
+	raw, ok := args[key]
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+func equalSecret(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
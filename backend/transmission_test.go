@@ -0,0 +1,195 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// transmissionClient talks to a Transmission RPC server the way clients do,
+// picking up the session id from the first 409
+type transmissionClient struct {
+	url       string
+	sessionID string
+}
+
+func (c *transmissionClient) post(body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("admin", "secret")
+	req.Header.Set(transmissionSessionKey, c.sessionID)
+	return http.DefaultClient.Do(req)
+}
+
+func (c *transmissionClient) call(t *testing.T, method string, args interface{}, result interface{}) string {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]interface{}{"method": method, "arguments": args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.post(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		c.sessionID = resp.Header.Get(transmissionSessionKey)
+		resp, err = c.post(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s", method, resp.Status)
+	}
+
+	var reply struct {
+		Result    string          `json:"result"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != nil && reply.Result == "success" {
+		err = json.Unmarshal(reply.Arguments, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reply.Result
+}
+
+type trAdded struct {
+	Added     *struct{ ID int } `json:"torrent-added"`
+	Duplicate *struct{ ID int } `json:"torrent-duplicate"`
+}
+
+func TestTransmissionRPC(t *testing.T) {
+	newTestSession(t)
+
+	server := httptest.NewServer(NewTransmissionHandler("admin", "secret"))
+	defer server.Close()
+
+	// without credentials, then without the session id
+	resp, err := http.Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without credentials: got %s, want 401", resp.Status)
+	}
+
+	c := &transmissionClient{url: server.URL}
+	resp, err = c.post([]byte(`{"method":"session-get"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get(transmissionSessionKey) == "" {
+		t.Fatalf("request without session id: got %s, want 409 with a session id", resp.Status)
+	}
+
+	src := filepath.Join(t.TempDir(), "rpc.bin")
+	writeTestFile(t, src, 100000)
+	metainfo, err := CreateTorrent(src, "", 16<<10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var added trAdded
+	args := map[string]interface{}{"metainfo": base64.StdEncoding.EncodeToString(metainfo), "paused": true}
+	if result := c.call(t, "torrent-add", args, &added); result != "success" {
+		t.Fatalf("torrent-add: %s", result)
+	}
+	if added.Added == nil {
+		t.Fatal("torrent-add didn't add the torrent")
+	}
+	id := added.Added.ID
+	t.Cleanup(func() { RemoveTorrent(id, false) })
+
+	// adding it again by file name is a duplicate
+	torrentFile := filepath.Join(t.TempDir(), "rpc.torrent")
+	err = os.WriteFile(torrentFile, metainfo, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added = trAdded{}
+	c.call(t, "torrent-add", map[string]interface{}{"filename": torrentFile}, &added)
+	if added.Duplicate == nil || added.Duplicate.ID != id {
+		t.Errorf("adding by file name again: got %+v, want torrent-duplicate %d", added, id)
+	}
+
+	var got struct {
+		Torrents []struct {
+			ID        int    `json:"id"`
+			Name      string `json:"name"`
+			Status    int    `json:"status"`
+			TotalSize int64  `json:"totalSize"`
+		} `json:"torrents"`
+	}
+	args = map[string]interface{}{"ids": []int{id}, "fields": []string{"id", "name", "status", "totalSize"}}
+	if result := c.call(t, "torrent-get", args, &got); result != "success" {
+		t.Fatalf("torrent-get: %s", result)
+	}
+	if len(got.Torrents) != 1 {
+		t.Fatalf("torrent-get returned %d torrents, want 1", len(got.Torrents))
+	}
+	torrent := got.Torrents[0]
+	if torrent.ID != id || torrent.Name != "rpc.bin" || torrent.TotalSize != 100000 {
+		t.Errorf("torrent-get returned %+v", torrent)
+	}
+	if torrent.Status != trStatusStopped {
+		t.Errorf("torrent added paused has status %d, want %d", torrent.Status, trStatusStopped)
+	}
+
+	// the paused status survives a restart
+	rows, err := getResumeRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].torrent.Status != StatusPaused {
+		t.Error("paused status wasn't saved")
+	}
+}
+
+func TestUnauthenticatedBind(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:9091", true},
+		{"127.0.0.2:9091", true},
+		{"[::1]:9091", true},
+		{"localhost:9091", true},
+		{":9091", false},
+		{"0.0.0.0:9091", false},
+		{"[::]:9091", false},
+		{"192.0.2.1:9091", false},
+		{"example.com:9091", false},
+		{"127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if got := isLoopbackAddr(test.addr); got != test.want {
+			t.Errorf("isLoopbackAddr(%q) = %t, want %t", test.addr, got, test.want)
+		}
+	}
+
+	// servers without a username refuse to listen on every interface
+	if err := StartTransmissionRPC(":0", "", ""); err == nil {
+		t.Error("Transmission RPC without a username started on all interfaces")
+	}
+	if err := StartQBittorrentAPI("0.0.0.0:0", "", ""); err == nil {
+		t.Error("qBittorrent API without a username started on all interfaces")
+	}
+}
@@ -0,0 +1,904 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// uTP is the Micro Transport Protocol of BEP 29: reliable, ordered streams
+// over UDP whose LEDBAT congestion control backs off as soon as queues
+// build up on the link, leaving room for the user's other traffic
+
+// UTPEnabled makes us dial peers over uTP first and accept uTP connections
+var UTPEnabled = true
+
+// packet types
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+const (
+	utpVersion         = 1
+	utpHeaderSize      = 20
+	utpExtSelectiveAck = 1
+	// utpMaxPayload keeps packets under the usual 1500 byte MTU, IPv6
+	// headers included
+	utpMaxPayload = 1400
+	// LEDBAT aims for this much queuing delay, growing the window by at
+	// most utpMaxWindowIncrease bytes per round trip
+	utpTarget            = 100 * time.Millisecond
+	utpMaxWindowIncrease = 3000
+	utpInitialWindow     = 10 * utpMaxPayload
+	utpMinWindow         = utpMaxPayload
+	utpMaxWindow         = 4 << 20
+	utpRecvWindow        = 1 << 20
+	utpInitialTimeout    = time.Second
+	utpMinTimeout        = 500 * time.Millisecond
+	utpMaxTransmissions  = 6
+	utpConnectTimeout    = 3 * time.Second
+	// utpHeadStart is how long a uTP dial runs alone before TCP races it
+	utpHeadStart    = 500 * time.Millisecond
+	utpCloseTimeout = 10 * time.Second
+	// keep-alives hold NAT mappings open
+	utpKeepAlive    = 29 * time.Second
+	utpTickInterval = 50 * time.Millisecond
+	// a packet is resent once this many later ones were selectively acked
+	utpFastResendSkips = 3
+	utpAcceptBacklog   = 16
+)
+
+const (
+	utpSynSent = iota
+	utpConnected
+)
+
+var (
+	errUTPReset   = errors.New("uTP connection reset by peer")
+	errUTPTimeout = errors.New("uTP connection timed out")
+)
+
+type utpHeader struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	window        uint32
+	seq           uint16
+	ack           uint16
+	sack          []byte
+}
+
+func (h *utpHeader) marshal(payload []byte) []byte {
+	size := utpHeaderSize + len(payload)
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+
+	buf := make([]byte, utpHeaderSize, size)
+	buf[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.window)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	if h.sack != nil {
+		buf[1] = utpExtSelectiveAck
+		buf = append(buf, 0, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+	return append(buf, payload...)
+}
+
+// parseUTPPacket splits a datagram into its header and payload. Datagrams
+// that aren't uTP give false.
+func parseUTPPacket(b []byte) (*utpHeader, []byte, bool) {
+	if len(b) < utpHeaderSize || b[0]&0x0f != utpVersion || b[0]>>4 > utpSyn {
+		return nil, nil, false
+	}
+
+	h := &utpHeader{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:4]),
+		timestamp:     binary.BigEndian.Uint32(b[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:12]),
+		window:        binary.BigEndian.Uint32(b[12:16]),
+		seq:           binary.BigEndian.Uint16(b[16:18]),
+		ack:           binary.BigEndian.Uint16(b[18:20]),
+	}
+
+	ext, i := b[1], utpHeaderSize
+	for ext != 0 {
+		if i+2 > len(b) {
+			return nil, nil, false
+		}
+		next, length := b[i], int(b[i+1])
+		i += 2
+		if i+length > len(b) {
+			return nil, nil, false
+		}
+		if ext == utpExtSelectiveAck {
+			h.sack = b[i : i+length]
+		}
+		i += length
+		ext = next
+	}
+	return h, b[i:], true
+}
+
+func utpMicros(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
+
+func sackBit(sack []byte, i int) bool {
+	return sack[i/8]&(1<<(i%8)) != 0
+}
+
+// seqLess compares sequence numbers, which wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+type utpKey struct {
+	addr netip.AddrPort
+	id   uint16
+}
+
+// utpSocket multiplexes the uTP connections on our UDP port. Datagrams
+// that aren't uTP go to the handler set with SetUDPHandler.
+type utpSocket struct {
+	conn    *net.UDPConn
+	mutex   sync.Mutex
+	conns   map[utpKey]*utpConn
+	accepts chan *utpConn
+}
+
+var (
+	udpSocket      *utpSocket
+	udpSocketMutex sync.Mutex
+	// udpHandler gets the datagrams that aren't uTP, nil dropping them
+	udpHandler func(b []byte, addr netip.AddrPort)
+)
+
+// SetUDPHandler hands the datagrams on our UDP port that aren't uTP to
+// handler, so a DHT can share the port as BEP 29 intends. Nothing sets it
+// until gorrent has a DHT. Replies go out through SendUDP.
+func SetUDPHandler(handler func(b []byte, addr netip.AddrPort)) {
+	udpSocketMutex.Lock()
+	defer udpSocketMutex.Unlock()
+	udpHandler = handler
+}
+
+// SendUDP sends a datagram from our UDP port
+func SendUDP(b []byte, addr netip.AddrPort) error {
+	s := getUDPSocket()
+	if s == nil {
+		return fmt.Errorf("the UDP socket is not running")
+	}
+	_, err := s.conn.WriteToUDPAddrPort(b, addr)
+	return err
+}
+
+// StartUTP listens for uTP on the UDP port matching ListenPort. It's called
+// after StartPeerListener has settled the port.
+func StartUTP() error {
+	if !UTPEnabled {
+		return nil
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: ListenPort})
+	if err != nil {
+		return err
+	}
+
+	s := newUTPSocket(conn)
+	udpSocketMutex.Lock()
+	udpSocket = s
+	udpSocketMutex.Unlock()
+
+	go func() {
+		for c := range s.accepts {
+			go acceptPeer(c)
+		}
+	}()
+	return nil
+}
+
+// newUTPSocket runs uTP on conn. Accepted connections are sent on accepts.
+func newUTPSocket(conn *net.UDPConn) *utpSocket {
+	s := &utpSocket{
+		conn:    conn,
+		conns:   make(map[utpKey]*utpConn),
+		accepts: make(chan *utpConn, utpAcceptBacklog),
+	}
+	go s.serve()
+	return s
+}
+
+func getUDPSocket() *utpSocket {
+	udpSocketMutex.Lock()
+	defer udpSocketMutex.Unlock()
+	return udpSocket
+}
+
+func (s *utpSocket) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			fmt.Println("UDP socket stopped:", err)
+			return
+		}
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		packet := append([]byte(nil), buf[:n]...)
+
+		h, payload, ok := parseUTPPacket(packet)
+		if !ok {
+			udpSocketMutex.Lock()
+			handler := udpHandler
+			udpSocketMutex.Unlock()
+			if handler != nil {
+				handler(packet, addr)
+			}
+			continue
+		}
+		s.dispatch(h, payload, addr)
+	}
+}
+
+// dispatch hands a packet to its connection. A SYN carries the id the
+// connection will receive on minus one.
+func (s *utpSocket) dispatch(h *utpHeader, payload []byte, addr netip.AddrPort) {
+	key := utpKey{addr: addr, id: h.connID}
+	if h.typ == utpSyn {
+		key.id++
+	}
+
+	s.mutex.Lock()
+	c := s.conns[key]
+	if c == nil && h.typ == utpReset {
+		// some implementations reset with the id they send on
+		for _, other := range s.conns {
+			if other.remote == addr && other.sendID == h.connID {
+				c = other
+				break
+			}
+		}
+	}
+
+	accepted := false
+	if c == nil && h.typ == utpSyn && UTPEnabled {
+		c = newUTPConn(s, addr, key.id, h.connID)
+		c.state = utpConnected
+		c.seq = uint16(rand.Intn(0x10000))
+		c.ack = h.seq
+		s.conns[key] = c
+		accepted = true
+	}
+	s.mutex.Unlock()
+
+	if c == nil {
+		if h.typ != utpReset {
+			s.send(addr, (&utpHeader{typ: utpReset, connID: h.connID, timestamp: utpMicros(time.Now()), ack: h.seq}).marshal(nil))
+		}
+		return
+	}
+
+	c.receive(h, payload)
+
+	if accepted {
+		go c.run()
+		select {
+		case s.accepts <- c:
+		default:
+			c.Close()
+		}
+	}
+}
+
+func (s *utpSocket) send(addr netip.AddrPort, packet []byte) {
+	_, err := s.conn.WriteToUDPAddrPort(packet, addr)
+	if err != nil {
+		fmt.Println("Error sending uTP packet:", err)
+	}
+}
+
+func (s *utpSocket) remove(c *utpConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, utpKey{addr: c.remote, id: c.recvID})
+}
+
+// dialUTP opens a uTP connection, failing if the peer doesn't answer
+// within timeout or ctx is done first
+func dialUTP(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	s := getUDPSocket()
+	if s == nil {
+		return nil, fmt.Errorf("uTP is not running")
+	}
+	return s.dial(ctx, address, timeout)
+}
+
+func (s *utpSocket) dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	addr := netip.AddrPortFrom(ip.Unmap(), uint16(port))
+
+	s.mutex.Lock()
+	var c *utpConn
+	for c == nil {
+		id := uint16(rand.Intn(0x10000))
+		if _, taken := s.conns[utpKey{addr: addr, id: id}]; !taken {
+			c = newUTPConn(s, addr, id, id+1)
+			s.conns[utpKey{addr: addr, id: id}] = c
+		}
+	}
+	s.mutex.Unlock()
+	go c.run()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.mutex.Lock()
+		c.fail(ctx.Err())
+		c.mutex.Unlock()
+	})
+	defer stop()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.seq = 1
+	c.sendPacket(utpSyn, nil)
+
+	deadline := time.Now().Add(timeout)
+	for c.state == utpSynSent && c.err == nil {
+		err := c.wait(deadline)
+		if err != nil {
+			c.fail(errUTPTimeout)
+		}
+	}
+	if c.err != nil {
+		c.closed = true
+		return nil, c.err
+	}
+	return c, nil
+}
+
+type utpPacket struct {
+	typ           uint8
+	seq           uint16
+	payload       []byte
+	sent          time.Time
+	transmissions int
+	acked         bool
+	fastResent    bool
+}
+
+// utpConn is a uTP connection. Its state is guarded by mutex and every
+// change closes the changed channel, which wakes up blocked Reads and Writes.
+type utpConn struct {
+	socket *utpSocket
+	remote netip.AddrPort
+	recvID uint16
+	sendID uint16
+
+	mutex   sync.Mutex
+	changed chan struct{}
+	state   int
+	// err is set once the connection failed, closed when Close was called
+	err     error
+	closed  bool
+	closeAt time.Time
+
+	// seq is the next sequence number we send, ack the last one we got
+	// in order
+	seq uint16
+	ack uint16
+
+	inflight   []*utpPacket
+	curWindow  int
+	maxWindow  int
+	peerWindow int
+
+	readBuf     bytes.Buffer
+	outOfOrder  map[uint16][]byte
+	gotFin      bool
+	finSeq      uint16
+	eof         bool
+	replyMicros uint32
+
+	rtt     time.Duration
+	rttVar  time.Duration
+	timeout time.Duration
+
+	// the lowest delays of this and the previous minute, the lower one
+	// being LEDBAT's base delay
+	delayMins   [2]uint32
+	delayMinute time.Time
+
+	lastSend      time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUTPConn(s *utpSocket, remote netip.AddrPort, recvID, sendID uint16) *utpConn {
+	now := time.Now()
+	return &utpConn{
+		socket:      s,
+		remote:      remote,
+		recvID:      recvID,
+		sendID:      sendID,
+		changed:     make(chan struct{}),
+		state:       utpSynSent,
+		maxWindow:   utpInitialWindow,
+		peerWindow:  utpRecvWindow,
+		outOfOrder:  make(map[uint16][]byte),
+		timeout:     utpInitialTimeout,
+		delayMins:   [2]uint32{^uint32(0), ^uint32(0)},
+		delayMinute: now,
+		lastSend:    now,
+	}
+}
+
+// broadcast wakes everyone waiting on the connection. The mutex must be held.
+func (c *utpConn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait blocks until the connection changes or the deadline passes. It's
+// called with the mutex held and returns with it held.
+func (c *utpConn) wait(deadline time.Time) error {
+	changed := c.changed
+	c.mutex.Unlock()
+	defer c.mutex.Lock()
+
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *utpConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.inflight = nil
+	c.curWindow = 0
+	c.broadcast()
+}
+
+// receiveWindow is the buffer space we advertise
+func (c *utpConn) receiveWindow() uint32 {
+	used := c.readBuf.Len()
+	for _, p := range c.outOfOrder {
+		used += len(p)
+	}
+	return uint32(max(utpRecvWindow-used, 0))
+}
+
+// selectiveAck flags the packets after the next expected one we already have
+func (c *utpConn) selectiveAck() []byte {
+	if len(c.outOfOrder) == 0 {
+		return nil
+	}
+
+	sack := make([]byte, 4)
+	for i := 0; i < len(sack)*8; i++ {
+		if _, ok := c.outOfOrder[c.ack+2+uint16(i)]; ok {
+			sack[i/8] |= 1 << (i % 8)
+		}
+	}
+	return sack
+}
+
+func (c *utpConn) header(typ uint8, seq uint16, now time.Time) *utpHeader {
+	// a SYN tells the peer the id we receive on
+	connID := c.sendID
+	if typ == utpSyn {
+		connID = c.recvID
+	}
+
+	return &utpHeader{
+		typ:           typ,
+		connID:        connID,
+		timestamp:     utpMicros(now),
+		timestampDiff: c.replyMicros,
+		window:        c.receiveWindow(),
+		seq:           seq,
+		ack:           c.ack,
+		sack:          c.selectiveAck(),
+	}
+}
+
+// sendPacket queues a packet taking a sequence number and sends it
+func (c *utpConn) sendPacket(typ uint8, payload []byte) {
+	p := &utpPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.inflight = append(c.inflight, p)
+	c.curWindow += len(payload)
+	c.transmit(p)
+}
+
+func (c *utpConn) transmit(p *utpPacket) {
+	now := time.Now()
+	p.sent = now
+	p.transmissions++
+	c.lastSend = now
+	c.socket.send(c.remote, c.header(p.typ, p.seq, now).marshal(p.payload))
+}
+
+// sendState acks what we received, without taking a sequence number
+func (c *utpConn) sendState() {
+	now := time.Now()
+	c.lastSend = now
+	c.socket.send(c.remote, c.header(utpState, c.seq, now).marshal(nil))
+}
+
+func (c *utpConn) receive(h *utpHeader, payload []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer c.broadcast()
+
+	now := time.Now()
+	c.replyMicros = utpMicros(now) - h.timestamp
+	c.peerWindow = int(h.window)
+
+	switch h.typ {
+	case utpReset:
+		c.fail(errUTPReset)
+		return
+	case utpSyn:
+		// the first SYN, or a resent one because our answer got lost
+		c.sendState()
+		return
+	}
+
+	if c.state == utpSynSent {
+		if h.typ != utpState {
+			return
+		}
+		c.state = utpConnected
+		c.ack = h.seq - 1
+	}
+
+	c.processAck(h, now)
+
+	switch h.typ {
+	case utpData:
+		c.receiveData(h.seq, payload)
+		c.sendState()
+	case utpFin:
+		c.gotFin = true
+		c.finSeq = h.seq
+		c.receiveData(h.seq, nil)
+		c.sendState()
+	}
+}
+
+func (c *utpConn) receiveData(seq uint16, payload []byte) {
+	if !seqLess(c.ack, seq) || seq-c.ack > utpRecvWindow/utpMaxPayload*2 {
+		// a duplicate, or too far ahead to be real
+		return
+	}
+
+	if seq != c.ack+1 {
+		c.outOfOrder[seq] = payload
+		return
+	}
+
+	c.readBuf.Write(payload)
+	c.ack = seq
+	for {
+		next, ok := c.outOfOrder[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.outOfOrder, c.ack+1)
+		c.readBuf.Write(next)
+		c.ack++
+	}
+
+	if c.gotFin && c.ack == c.finSeq {
+		c.eof = true
+	}
+}
+
+// processAck drops the packets the peer acknowledged, resends those it
+// skipped and adjusts the window
+func (c *utpConn) processAck(h *utpHeader, now time.Time) {
+	acked, count := 0, 0
+	ack := func(p *utpPacket) {
+		p.acked = true
+		acked += len(p.payload)
+		count++
+		// resent packets don't give a usable round trip time
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sent))
+		}
+	}
+
+	for _, p := range c.inflight {
+		if seqLess(h.ack, p.seq) {
+			break
+		}
+		ack(p)
+	}
+
+	if h.sack != nil {
+		lost := false
+		for _, p := range c.inflight {
+			bit := int(int16(p.seq - h.ack - 2))
+			if p.acked || bit >= len(h.sack)*8 {
+				continue
+			}
+			if bit >= 0 && sackBit(h.sack, bit) {
+				ack(p)
+				continue
+			}
+
+			later := 0
+			for i := bit + 1; i < len(h.sack)*8; i++ {
+				if sackBit(h.sack, i) {
+					later++
+				}
+			}
+			if later >= utpFastResendSkips && !p.fastResent {
+				p.fastResent = true
+				lost = true
+				c.transmit(p)
+			}
+		}
+		if lost {
+			// losses are taken as congestion
+			c.maxWindow = max(c.maxWindow/2, utpMinWindow)
+		}
+	}
+
+	if count == 0 {
+		return
+	}
+
+	remaining := c.inflight[:0]
+	for _, p := range c.inflight {
+		if !p.acked {
+			remaining = append(remaining, p)
+		}
+	}
+	c.inflight = remaining
+	c.curWindow -= acked
+	if c.rtt != 0 {
+		// progress ends the backoff of earlier timeouts
+		c.timeout = max(c.rtt+4*c.rttVar, utpMinTimeout)
+	}
+
+	if h.timestampDiff != 0 && acked > 0 {
+		c.updateWindow(acked, h.timestampDiff, now)
+	}
+}
+
+func (c *utpConn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.timeout = max(c.rtt+4*c.rttVar, utpMinTimeout)
+}
+
+// updateWindow is LEDBAT: the window grows while the delay our packets see
+// stays under the target above the base delay, and shrinks past it
+func (c *utpConn) updateWindow(acked int, delay uint32, now time.Time) {
+	if now.Sub(c.delayMinute) > time.Minute {
+		c.delayMins[1] = c.delayMins[0]
+		c.delayMins[0] = delay
+		c.delayMinute = now
+	} else if delay < c.delayMins[0] {
+		c.delayMins[0] = delay
+	}
+	base := min(c.delayMins[0], c.delayMins[1])
+
+	ourDelay := time.Duration(delay-base) * time.Microsecond
+	offTarget := float64(utpTarget-ourDelay) / float64(utpTarget)
+	windowFactor := float64(acked) / float64(max(c.maxWindow, acked))
+	c.maxWindow += int(utpMaxWindowIncrease * offTarget * windowFactor)
+	c.maxWindow = min(max(c.maxWindow, utpMinWindow), utpMaxWindow)
+}
+
+// run resends timed out packets and keeps the connection alive until it's
+// done, then removes it from the socket
+func (c *utpConn) run() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if !c.tick(now) {
+			c.socket.remove(c)
+			return
+		}
+	}
+}
+
+func (c *utpConn) tick(now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil && !c.closed {
+		// wait for Close so the id isn't reused under the user
+		return true
+	}
+	if c.closed && (c.err != nil || len(c.inflight) == 0 || now.After(c.closeAt)) {
+		return false
+	}
+
+	if len(c.inflight) > 0 {
+		p := c.inflight[0]
+		if now.Sub(p.sent) > c.timeout {
+			if p.transmissions >= utpMaxTransmissions {
+				c.fail(errUTPTimeout)
+				return true
+			}
+			c.maxWindow = utpMinWindow
+			c.timeout *= 2
+			c.transmit(p)
+		}
+	} else if c.state == utpConnected && now.Sub(c.lastSend) > utpKeepAlive {
+		c.sendState()
+	}
+	return true
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.readBuf.Len() > 0:
+			full := c.readBuf.Len() >= utpRecvWindow/2
+			n, _ := c.readBuf.Read(b)
+			if full && c.readBuf.Len() < utpRecvWindow/2 {
+				// tell the peer it can send again
+				c.sendState()
+			}
+			return n, nil
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+
+		err := c.wait(c.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	written := 0
+	for written < len(b) {
+		size := min(len(b)-written, utpMaxPayload)
+		for {
+			if c.closed {
+				return written, net.ErrClosed
+			}
+			if c.err != nil {
+				return written, c.err
+			}
+			window := min(c.maxWindow, c.peerWindow)
+			if c.state == utpConnected && (len(c.inflight) == 0 || c.curWindow+size <= window) {
+				break
+			}
+
+			err := c.wait(c.writeDeadline)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		c.sendPacket(utpData, append([]byte(nil), b[written:written+size]...))
+		written += size
+	}
+	return written, nil
+}
+
+// Close sends a FIN after the data still in flight. The connection lingers
+// in the background until the peer acks it.
+func (c *utpConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.closeAt = time.Now().Add(utpCloseTimeout)
+	if c.err == nil && c.state == utpConnected {
+		c.sendPacket(utpFin, nil)
+	}
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.remote)
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
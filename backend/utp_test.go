@@ -0,0 +1,391 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestUTPSocket runs uTP on a loopback port until the test ends
+func newTestUTPSocket(t *testing.T) *utpSocket {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newUTPSocket(conn)
+}
+
+func utpAddr(s *utpSocket) string {
+	return s.conn.LocalAddr().String()
+}
+
+// utpPair connects a dialing socket to an accepting one through address,
+// which is the accepting socket's or a proxy's in front of it
+func utpPair(t *testing.T, dialer, acceptor *utpSocket, address string) (net.Conn, net.Conn) {
+	t.Helper()
+
+	conn, err := dialer.dial(context.Background(), address, utpConnectTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case accepted := <-acceptor.accepts:
+		return conn, accepted
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted")
+	}
+	return nil, nil
+}
+
+// utpProxy forwards datagrams between a dialer and target, dropping those
+// drop picks
+type utpProxy struct {
+	conn   *net.UDPConn
+	target netip.AddrPort
+	drop   func(toTarget bool, h *utpHeader, payload []byte) bool
+}
+
+func newUTPProxy(t *testing.T, target string, drop func(toTarget bool, h *utpHeader, payload []byte) bool) *utpProxy {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	p := &utpProxy{conn: conn, target: netip.MustParseAddrPort(target), drop: drop}
+	go p.run()
+	return p
+}
+
+func (p *utpProxy) run() {
+	var client netip.AddrPort
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := p.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		to, toTarget := p.target, true
+		if from == p.target {
+			to, toTarget = client, false
+		} else {
+			client = from
+		}
+		h, payload, ok := parseUTPPacket(buf[:n])
+		if ok && p.drop(toTarget, h, payload) {
+			continue
+		}
+		p.conn.WriteToUDPAddrPort(buf[:n], to)
+	}
+}
+
+func (p *utpProxy) addr() string {
+	return p.conn.LocalAddr().String()
+}
+
+// exchange sends data both ways at once and checks it arrives intact
+func exchange(t *testing.T, a, b net.Conn, size int) {
+	t.Helper()
+
+	toB, toA := make([]byte, size), make([]byte, size)
+	rand.Read(toB)
+	rand.Read(toA)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, c := range []struct {
+		conn net.Conn
+		out  []byte
+		in   []byte
+	}{{a, toB, toA}, {b, toA, toB}} {
+		c := c
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := c.conn.Write(c.out)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			got := make([]byte, len(c.in))
+			_, err := io.ReadFull(c.conn, got)
+			if err == nil && !bytes.Equal(got, c.in) {
+				err = errors.New("received data differs from what was sent")
+			}
+			errs <- err
+		}()
+	}
+
+	a.SetDeadline(time.Now().Add(20 * time.Second))
+	b.SetDeadline(time.Now().Add(20 * time.Second))
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.SetDeadline(time.Time{})
+	b.SetDeadline(time.Time{})
+}
+
+func TestUTPTransfer(t *testing.T) {
+	dialer, acceptor := newTestUTPSocket(t), newTestUTPSocket(t)
+	a, b := utpPair(t, dialer, acceptor, utpAddr(acceptor))
+	defer a.Close()
+	defer b.Close()
+
+	exchange(t, a, b, 2<<20)
+}
+
+// TestUTPSelectiveAck drops a data packet once. The acceptor acks the
+// packets after it selectively, and the dialer resends it without waiting
+// for the retransmission timeout.
+func TestUTPSelectiveAck(t *testing.T) {
+	dialer, acceptor := newTestUTPSocket(t), newTestUTPSocket(t)
+
+	var mutex sync.Mutex
+	var dropped uint16
+	var droppedAt, resentAt time.Time
+	sacks := 0
+	proxy := newUTPProxy(t, utpAddr(acceptor), func(toTarget bool, h *utpHeader, payload []byte) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case !toTarget && h.sack != nil:
+			sacks++
+		case toTarget && h.typ == utpData && droppedAt.IsZero():
+			if len(payload) > 0 && payload[0] == 0xff {
+				dropped, droppedAt = h.seq, time.Now()
+				return true
+			}
+		case toTarget && h.typ == utpData && h.seq == dropped && resentAt.IsZero():
+			resentAt = time.Now()
+		}
+		return false
+	})
+
+	a, b := utpPair(t, dialer, acceptor, proxy.addr())
+	defer a.Close()
+	defer b.Close()
+
+	// the packet starting with 0xff is dropped, with plenty sent after it
+	data := make([]byte, 40*utpMaxPayload)
+	data[5*utpMaxPayload] = 0xff
+	go a.Write(data)
+
+	got := make([]byte, len(data))
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := io.ReadFull(b, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("received data differs from what was sent")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if droppedAt.IsZero() || resentAt.IsZero() {
+		t.Fatal("the packet wasn't dropped and resent")
+	}
+	if sacks == 0 {
+		t.Error("no selective acks were sent")
+	}
+	if delay := resentAt.Sub(droppedAt); delay >= utpMinTimeout {
+		t.Errorf("dropped packet was resent after %v, not fast resent", delay)
+	}
+}
+
+// TestUTPLoss drops packets at random both ways, handshake and FIN included
+func TestUTPLoss(t *testing.T) {
+	dialer, acceptor := newTestUTPSocket(t), newTestUTPSocket(t)
+
+	random := mathrand.New(mathrand.NewSource(1))
+	var mutex sync.Mutex
+	proxy := newUTPProxy(t, utpAddr(acceptor), func(toTarget bool, h *utpHeader, payload []byte) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return random.Intn(100) < 5
+	})
+
+	a, b := utpPair(t, dialer, acceptor, proxy.addr())
+	exchange(t, a, b, 300<<10)
+
+	a.Close()
+	b.SetReadDeadline(time.Now().Add(20 * time.Second))
+	_, err := b.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("read after the peer closed: got %v, want EOF", err)
+	}
+	b.Close()
+}
+
+// TestUTPClose checks the FIN: the reader gets the data then EOF, and both
+// sockets forget the connection once it's closed on both sides
+func TestUTPClose(t *testing.T) {
+	dialer, acceptor := newTestUTPSocket(t), newTestUTPSocket(t)
+	a, b := utpPair(t, dialer, acceptor, utpAddr(acceptor))
+
+	_, err := a.Write([]byte("last words"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "last words" {
+		t.Errorf("got %q before EOF, want the data sent before closing", got)
+	}
+	if _, err := a.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read on a closed connection: got %v, want net.ErrClosed", err)
+	}
+	if _, err := a.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write on a closed connection: got %v, want net.ErrClosed", err)
+	}
+	b.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, s := range []*utpSocket{dialer, acceptor} {
+		for {
+			s.mutex.Lock()
+			n := len(s.conns)
+			s.mutex.Unlock()
+			if n == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d closed connections are still on the socket", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// useTestUDPSocket makes s the socket dialUTP and SendUDP use until the
+// test ends
+func useTestUDPSocket(t *testing.T, s *utpSocket) {
+	udpSocketMutex.Lock()
+	previous := udpSocket
+	udpSocket = s
+	udpSocketMutex.Unlock()
+	t.Cleanup(func() {
+		udpSocketMutex.Lock()
+		udpSocket = previous
+		udpSocketMutex.Unlock()
+	})
+}
+
+func TestUDPHandler(t *testing.T) {
+	s := newTestUTPSocket(t)
+	useTestUDPSocket(t, s)
+
+	received := make(chan netip.AddrPort, 1)
+	SetUDPHandler(func(b []byte, addr netip.AddrPort) {
+		if string(b) == "d1:q4:pinge" {
+			received <- addr
+		}
+	})
+	t.Cleanup(func() { SetUDPHandler(nil) })
+
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, err = other.WriteTo([]byte("d1:q4:pinge"), s.conn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var from netip.AddrPort
+	select {
+	case from = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the datagram didn't reach the handler")
+	}
+
+	err = SendUDP([]byte("d1:r4:ponge"), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := other.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "d1:r4:ponge" {
+		t.Errorf("got %q back", buf[:n])
+	}
+}
+
+func TestDialPeer(t *testing.T) {
+	useTestUDPSocket(t, newTestUTPSocket(t))
+
+	// a peer with uTP and TCP on the same port is dialed over uTP
+	acceptor := newTestUTPSocket(t)
+	port := acceptor.conn.LocalAddr().(*net.UDPAddr).Port
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err == nil {
+		defer tcp.Close()
+	}
+	peer := &Peer{IP: "127.0.0.1", Port: fmt.Sprint(port)}
+	conn, err := dialPeer(context.Background(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if peer.Transport != TransportUTP || peer.noUTP {
+		t.Errorf("peer with uTP was dialed over %s", peer.Transport)
+	}
+
+	// a TCP-only peer waits for the head start, not the uTP timeout
+	tcpOnly, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpOnly.Close()
+	peer = &Peer{IP: "127.0.0.1", Port: fmt.Sprint(tcpOnly.Addr().(*net.TCPAddr).Port)}
+	start := time.Now()
+	conn, err = dialPeer(context.Background(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if peer.Transport != TransportTCP || !peer.noUTP {
+		t.Errorf("TCP-only peer was dialed over %s", peer.Transport)
+	}
+	if elapsed := time.Since(start); elapsed >= utpConnectTimeout {
+		t.Errorf("dialing a TCP-only peer took %v", elapsed)
+	}
+
+	// a cancelled dial stops both attempts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dialPeer(ctx, &Peer{IP: "127.0.0.1", Port: "9"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled dial: got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// verifyPieces hashes the stored data of every piece and returns the ones
+// that match. Pieces that can't be read count as missing.
+func verifyPieces(t *Torrent, s *Storage) Bitfield {
+	bt := t.bencodeTorrent
+	numPieces := bt.NumPieces()
+	have := NewBitfield(make([]byte, (numPieces+7)/8))
+
+	for i := 0; i < numPieces; i++ {
+		start, end := t.pieceSpan(i)
+		data := make([]byte, end-start)
+		_, err := s.ReadAt(data, start)
+		if err != nil {
+			continue
+		}
+
+		if bt.VerifyPiece(uint32(i), data) {
+			have.SetPiece(i)
+		}
+	}
+	return have
+}
+
+// Verify rehashes the downloaded data and replaces the bitfield with the
+// pieces that are actually on disk. It returns how many pieces are good.
+func (c *Client) Verify() int {
+	have := verifyPieces(c.Torrent, c.storage)
+
+	c.mutex.Lock()
+	copy(c.Bitfield, have)
+	c.mutex.Unlock()
+
+	return countPieces(have, c.Torrent.bencodeTorrent.NumPieces())
+}
+
+// VerifyTorrent stops a torrent, rechecks its data and puts it back in the queue
+func VerifyTorrent(torrentID int) error {
+	cl := GetClient(torrentID)
+	if cl == nil {
+		return fmt.Errorf("torrent %d not found", torrentID)
+	}
+
+	cl.Stop()
+	good := cl.Verify()
+	fmt.Printf("Verified %s: %d of %d pieces\n", cl.Torrent.TorrentName, good, cl.Torrent.bencodeTorrent.NumPieces())
+
+	err := saveResumeData(cl)
+	if err != nil {
+		return err
+	}
+
+	updateQueue()
+	return nil
+}
+
+// VerifyMetainfo checks the data of a .torrent file found in dir, without
+// adding it to the session. It returns the good and total piece counts.
+func VerifyMetainfo(metainfo []byte, dir string) (int, int, error) {
+	bcode, err := getBencode(bytes.NewReader(metainfo))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	t := NewTorrent(bcode)
+	s := NewStorage(t)
+	s.dir = dir
+
+	have := verifyPieces(t, s)
+	return countPieces(have, bcode.NumPieces()), bcode.NumPieces(), nil
+}
+
+func countPieces(bf Bitfield, numPieces int) int {
+	count := 0
+	for i := 0; i < numPieces; i++ {
+		if bf.HasPiece(i) {
+			count++
+		}
+	}
+	return count
+}
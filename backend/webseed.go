@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Web seeds (BEP 19) are HTTP servers holding the torrent's files. Each
+// one gets a worker that downloads whole pieces with range requests, like
+// a peer that has every piece.
+
+const (
+	// webSeedIdle is how long a web seed waits when there's nothing to fetch
+	webSeedIdle = 5 * time.Second
+	// webSeedTimeout bounds the requests of a single piece
+	webSeedTimeout = time.Minute
+	// maxWebSeedFailures caps the doubling of a failing web seed's backoff
+	maxWebSeedFailures = 16
+)
+
+// startWebSeeds downloads from the torrent's web seeds until ctx is done
+func (c *Client) startWebSeeds(ctx context.Context) {
+	for _, seedURL := range c.Torrent.bencodeTorrent.webSeeds {
+		if !strings.HasPrefix(seedURL, "http://") && !strings.HasPrefix(seedURL, "https://") {
+			fmt.Println("Skipping web seed, only HTTP is supported:", seedURL)
+			continue
+		}
+		go c.runWebSeed(ctx, seedURL)
+	}
+}
+
+// runWebSeed fetches the pieces the picker hands it from one web seed,
+// backing off while the seed fails
+func (c *Client) runWebSeed(ctx context.Context, seedURL string) {
+	have := fullBitfield(c.Torrent.bencodeTorrent.NumPieces())
+	c.picker.AddAvailability(have)
+	defer c.picker.RemoveAvailability(have)
+
+	failures := 0
+	for {
+		wait := webSeedIdle
+
+		c.mutex.Lock()
+		index, ok := c.picker.Pick(have, c.Bitfield)
+		c.mutex.Unlock()
+		if ok {
+			err := c.downloadWebSeedPiece(ctx, seedURL, index)
+			if err == nil {
+				failures = 0
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			failures = min(failures+1, maxWebSeedFailures)
+			wait = min(retryBackoff<<(failures-1), maxRetryBackoff)
+			fmt.Printf("Web seed %s failed, retrying in %s: %v\n", seedURL, wait, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// downloadWebSeedPiece fetches, checks and stores a piece the picker gave
+// out, handing it back on failure
+func (c *Client) downloadWebSeedPiece(ctx context.Context, seedURL string, index int) error {
+	start, end := c.Torrent.pieceSpan(index)
+	buf := make([]byte, end-start)
+
+	err := c.fetchWebSeedRange(ctx, seedURL, start, buf)
+	if err != nil {
+		c.picker.Abort(index)
+		return err
+	}
+
+	if !c.Torrent.bencodeTorrent.VerifyPiece(uint32(index), buf) {
+		c.picker.Abort(index)
+		c.wasted.Add(int64(len(buf)))
+		return fmt.Errorf("piece %d failed its hash check", index)
+	}
+
+	err = c.storePiece(index, buf)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Received piece %d, length %d from web seed %s\n", index, len(buf), seedURL)
+	return nil
+}
+
+// fetchWebSeedRange fills buf with the torrent's data from offset on,
+// requesting each file the range crosses
+func (c *Client) fetchWebSeedRange(ctx context.Context, seedURL string, offset int64, buf []byte) error {
+	for i, f := range c.Torrent.files() {
+		from := max(f.offset, offset)
+		to := min(f.offset+f.length, offset+int64(len(buf)))
+		if from >= to {
+			continue
+		}
+
+		fileURL := webSeedFileURL(seedURL, &c.Torrent.bencodeTorrent.Info, i)
+		err := c.fetchWebSeedFile(ctx, fileURL, from-f.offset, buf[from-offset:to-offset])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchWebSeedFile reads len(p) bytes of a file from offset with a range request
+func (c *Client) fetchWebSeedFile(ctx context.Context, fileURL string, offset int64, p []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(p))-1))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return fmt.Errorf("%s: unexpected range %q", fileURL, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// the server ignored the range and sends the whole file
+		_, err = io.CopyN(io.Discard, resp.Body, offset)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: %s", fileURL, resp.Status)
+	}
+
+	_, err = io.ReadFull(&webSeedReader{r: resp.Body, client: c}, p)
+	return err
+}
+
+// webSeedFileURL is where a web seed serves file i of the torrent. A URL
+// ending in a slash is a directory holding the torrent, otherwise it's the
+// file of a single file torrent.
+func webSeedFileURL(seedURL string, info *bencodeInfo, i int) string {
+	if len(info.Files) == 0 {
+		if strings.HasSuffix(seedURL, "/") {
+			return seedURL + url.PathEscape(info.Name)
+		}
+		return seedURL
+	}
+
+	if !strings.HasSuffix(seedURL, "/") {
+		seedURL += "/"
+	}
+	elements := []string{url.PathEscape(info.Name)}
+	for _, element := range info.Files[i].Path {
+		elements = append(elements, url.PathEscape(element))
+	}
+	return seedURL + strings.Join(elements, "/")
+}
+
+// webSeedReader pays the download limiters for what a web seed sends and
+// counts it as downloaded
+type webSeedReader struct {
+	r      io.Reader
+	client *Client
+}
+
+func (r *webSeedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p[:min(len(p), BlockSize)])
+	if n > 0 {
+		downloadLimiter.WaitN(n)
+		r.client.downloadLimiter.WaitN(n)
+		atomic.AddInt64(&r.client.Torrent.Downloaded, int64(n))
+	}
+	return n, err
+}
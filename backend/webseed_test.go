@@ -0,0 +1,123 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runTestWebSeed runs a web seed worker for the client until the test ends
+func runTestWebSeed(t *testing.T, cl *Client, seedURL string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cl.runWebSeed(ctx, seedURL)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	newTestSession(t)
+
+	// the files don't line up with the 16 KiB pieces, so pieces span them
+	root := t.TempDir()
+	files := map[string][]byte{
+		"a.bin":       writeTestFile(t, filepath.Join(root, "multi", "a.bin"), 40000),
+		"sub/b b.bin": writeTestFile(t, filepath.Join(root, "multi", "sub", "b b.bin"), 30000),
+		"c.txt":       writeTestFile(t, filepath.Join(root, "multi", "c.txt"), 5000),
+	}
+	torrent := addTestTorrent(t, filepath.Join(root, "multi"), 16<<10)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer server.Close()
+
+	cl := NewClient(torrent)
+	runTestWebSeed(t, cl, server.URL+"/")
+	if !waitComplete(cl, 10*time.Second) {
+		t.Fatal("download didn't complete")
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(DownloadDir, "multi", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from the web seed's", name)
+		}
+	}
+}
+
+func TestWebSeedWithoutRanges(t *testing.T) {
+	newTestSession(t)
+
+	src := filepath.Join(t.TempDir(), "single.bin")
+	data := writeTestFile(t, src, 50000)
+	torrent := addTestTorrent(t, src, 16<<10)
+
+	// a server that ignores Range and always sends the whole file
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	cl := NewClient(torrent)
+	runTestWebSeed(t, cl, server.URL+"/single.bin")
+	if !waitComplete(cl, 10*time.Second) {
+		t.Fatal("download didn't complete")
+	}
+
+	got, err := os.ReadFile(filepath.Join(DownloadDir, "single.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("single.bin differs from the web seed's")
+	}
+}
+
+func TestWebSeedBackoff(t *testing.T) {
+	newTestSession(t)
+
+	src := filepath.Join(t.TempDir(), "failing.bin")
+	writeTestFile(t, src, 50000)
+	torrent := addTestTorrent(t, src, 16<<10)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cl := NewClient(torrent)
+	runTestWebSeed(t, cl, server.URL+"/failing.bin")
+	time.Sleep(500 * time.Millisecond)
+
+	// the first failure waits retryBackoff before trying again
+	if n := requests.Load(); n != 1 {
+		t.Errorf("failing web seed got %d requests, want 1", n)
+	}
+	if cl.Completed() != 0 {
+		t.Error("pieces were stored from a failing web seed")
+	}
+
+	// the failed piece went back to the picker
+	cl.mutex.Lock()
+	_, ok := cl.picker.Pick(fullBitfield(torrent.bencodeTorrent.NumPieces()), cl.Bitfield)
+	cl.mutex.Unlock()
+	if !ok {
+		t.Error("failed piece wasn't handed back to the picker")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gorrent/backend"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	progressInterval = 500 * time.Millisecond
+	progressWidth    = 30
+)
+
+// download runs the engine in this process until one torrent is complete.
+// Nothing is kept once it exits: the database lives in a temporary file.
+func download(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	dir := fs.String("dir", ".", "directory to download into")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("download takes a single .torrent file or magnet link")
+	}
+
+	tmp, err := os.MkdirTemp("", "gorrent")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	backend.DatabasePath = filepath.Join(tmp, "gorrent.db")
+	backend.DownloadDir = *dir
+	// don't clash with a running daemon's ports
+	backend.StreamAddr = "127.0.0.1:0"
+	backend.ListenPort = 0
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = backend.StartSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer backend.Shutdown()
+
+	var t *backend.Torrent
+	if strings.HasPrefix(fs.Arg(0), "magnet:") {
+		fmt.Println("Fetching metadata")
+		t, _, err = backend.HandleMagnet(ctx, fs.Arg(0))
+	} else {
+		t, err = backend.HandleFile(ctx, fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	cl := backend.Enqueue(t)
+
+	// pick up data left by an earlier run
+	err = backend.VerifyTorrent(t.ID)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	last := cl.Completed()
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return fmt.Errorf("interrupted")
+		case <-ticker.C:
+		}
+
+		done := cl.Completed()
+		rate := float64(done-last) / progressInterval.Seconds()
+		last = done
+		printProgress(done, done+cl.Left(), rate, cl.PeerCount())
+
+		if cl.Complete() {
+			fmt.Println()
+			fmt.Println("Downloaded", t.TorrentName)
+			return nil
+		}
+	}
+}
+
+// printProgress redraws the progress line in place
+func printProgress(done, total int64, rate float64, peers int) {
+	fraction := 1.0
+	if total > 0 {
+		fraction = float64(done) / float64(total)
+	}
+
+	filled := int(fraction * progressWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+	fmt.Printf("\r[%s] %5.1f%%  %s / %s  %s/s  %d peers   ", bar, fraction*100,
+		formatBytes(done), formatBytes(total), formatBytes(int64(rate)), peers)
+}
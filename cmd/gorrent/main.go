@@ -0,0 +1,349 @@
+// gorrent controls a running gorrentd, or downloads a single torrent on its own
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"gorrent/backend"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `usage: gorrent [-socket path] <command> [arguments]
+
+commands talking to gorrentd:
+  add [-paused] <file|url|magnet>...   add torrents
+  list                                 list torrents
+  info <id>                            show a torrent and its files
+  pause <id>...                        pause torrents
+  resume <id>...                       resume torrents
+  remove [-delete-data] <id>...        remove torrents, and optionally their data
+  verify <id>...                       recheck downloaded data
+
+commands working without the daemon:
+  create [-announce url] [-piece-length n] [-private] [-o file] <path>
+                                       create a .torrent from a file or directory
+  verify [-dir path] <file.torrent>    check data already in dir
+  download [-dir path] <file.torrent|magnet>
+                                       download a torrent and exit
+`
+
+// trStatus names the Transmission status codes gorrentd reports
+var trStatus = map[int]string{
+	0: "paused",
+	3: "queued",
+	4: "downloading",
+	5: "queued",
+	6: "seeding",
+}
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	socket := flag.String("socket", backend.SocketPath, "gorrentd control socket")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	d := newDaemon(*socket)
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+
+	var err error
+	switch cmd {
+	case "add":
+		err = add(d, args)
+	case "list":
+		err = list(d)
+	case "info":
+		err = info(d, args)
+	case "pause":
+		err = each(d, "torrent-stop", args)
+	case "resume":
+		err = each(d, "torrent-start", args)
+	case "remove":
+		err = remove(d, args)
+	case "verify":
+		err = verify(d, args)
+	case "create":
+		err = create(args)
+	case "download":
+		err = download(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gorrent:", err)
+		os.Exit(1)
+	}
+}
+
+func add(d *daemon, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	paused := fs.Bool("paused", false, "add without starting")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("add needs a torrent file, URL or magnet link")
+	}
+
+	for _, source := range fs.Args() {
+		params := map[string]interface{}{"paused": *paused}
+		if isRemote(source) {
+			params["filename"] = source
+		} else {
+			// the daemon may not see our files, so send the contents
+			data, err := os.ReadFile(source)
+			if err != nil {
+				return err
+			}
+			params["metainfo"] = base64.StdEncoding.EncodeToString(data)
+		}
+
+		var result map[string]struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		}
+		err := d.call("torrent-add", params, &result)
+		if err != nil {
+			return fmt.Errorf("adding %s: %w", source, err)
+		}
+
+		if t, ok := result["torrent-duplicate"]; ok {
+			fmt.Printf("%d\t%s (already added)\n", t.ID, t.Name)
+		} else if t, ok := result["torrent-added"]; ok {
+			fmt.Printf("%d\t%s\n", t.ID, t.Name)
+		}
+	}
+	return nil
+}
+
+func isRemote(source string) bool {
+	return strings.HasPrefix(source, "magnet:") ||
+		strings.HasPrefix(source, "http://") ||
+		strings.HasPrefix(source, "https://")
+}
+
+type torrentInfo struct {
+	ID             int     `json:"id"`
+	Name           string  `json:"name"`
+	HashString     string  `json:"hashString"`
+	Status         int     `json:"status"`
+	PercentDone    float64 `json:"percentDone"`
+	TotalSize      int64   `json:"totalSize"`
+	LeftUntilDone  int64   `json:"leftUntilDone"`
+	UploadedEver   int64   `json:"uploadedEver"`
+	DownloadedEver int64   `json:"downloadedEver"`
+	UploadRatio    float64 `json:"uploadRatio"`
+	PeersConnected int     `json:"peersConnected"`
+	DownloadDir    string  `json:"downloadDir"`
+	QueuePosition  int     `json:"queuePosition"`
+	SecondsSeeding int64   `json:"secondsSeeding"`
+	Files          []struct {
+		Name           string `json:"name"`
+		Length         int64  `json:"length"`
+		BytesCompleted int64  `json:"bytesCompleted"`
+	} `json:"files"`
+	Wanted []bool `json:"wanted"`
+}
+
+func getTorrents(d *daemon, ids []int, fields ...string) ([]torrentInfo, error) {
+	params := map[string]interface{}{"fields": fields}
+	if ids != nil {
+		params["ids"] = ids
+	}
+
+	var result struct {
+		Torrents []torrentInfo `json:"torrents"`
+	}
+	err := d.call("torrent-get", params, &result)
+	return result.Torrents, err
+}
+
+func list(d *daemon) error {
+	torrents, err := getTorrents(d, nil, "id", "name", "status", "percentDone", "totalSize", "uploadRatio", "peersConnected")
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDONE\tSIZE\tRATIO\tPEERS\tSTATUS\tNAME")
+	for _, t := range torrents {
+		fmt.Fprintf(w, "%d\t%.1f%%\t%s\t%.2f\t%d\t%s\t%s\n", t.ID, t.PercentDone*100, formatBytes(t.TotalSize),
+			t.UploadRatio, t.PeersConnected, trStatus[t.Status], t.Name)
+	}
+	return w.Flush()
+}
+
+func info(d *daemon, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return fmt.Errorf("info takes a single torrent id")
+	}
+
+	torrents, err := getTorrents(d, ids, "id", "name", "hashString", "status", "percentDone", "totalSize",
+		"leftUntilDone", "uploadedEver", "downloadedEver", "uploadRatio", "peersConnected", "downloadDir",
+		"queuePosition", "secondsSeeding", "files", "wanted")
+	if err != nil {
+		return err
+	}
+	if len(torrents) == 0 {
+		return fmt.Errorf("torrent %d not found", ids[0])
+	}
+	t := torrents[0]
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", t.Name)
+	fmt.Fprintf(w, "ID:\t%d\n", t.ID)
+	fmt.Fprintf(w, "Info hash:\t%s\n", t.HashString)
+	fmt.Fprintf(w, "Status:\t%s\n", trStatus[t.Status])
+	fmt.Fprintf(w, "Queue position:\t%d\n", t.QueuePosition)
+	fmt.Fprintf(w, "Done:\t%.1f%% (%s left)\n", t.PercentDone*100, formatBytes(t.LeftUntilDone))
+	fmt.Fprintf(w, "Size:\t%s\n", formatBytes(t.TotalSize))
+	fmt.Fprintf(w, "Downloaded:\t%s\n", formatBytes(t.DownloadedEver))
+	fmt.Fprintf(w, "Uploaded:\t%s (ratio %.2f)\n", formatBytes(t.UploadedEver), t.UploadRatio)
+	fmt.Fprintf(w, "Seeding time:\t%dm\n", t.SecondsSeeding/60)
+	fmt.Fprintf(w, "Peers:\t%d\n", t.PeersConnected)
+	fmt.Fprintf(w, "Location:\t%s\n", t.DownloadDir)
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tDONE\tSIZE\tWANTED\tNAME")
+	for i, f := range t.Files {
+		done := 100.0
+		if f.Length > 0 {
+			done = float64(f.BytesCompleted) / float64(f.Length) * 100
+		}
+		wanted := "yes"
+		if i < len(t.Wanted) && !t.Wanted[i] {
+			wanted = "no"
+		}
+		fmt.Fprintf(w, "%d\t%.1f%%\t%s\t%s\t%s\n", i, done, formatBytes(f.Length), wanted, f.Name)
+	}
+	return w.Flush()
+}
+
+// each runs a method taking torrent ids on the given ones
+func each(d *daemon, method string, args []string) error {
+	ids, err := parseIDs(args)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no torrent ids given")
+	}
+	return d.call(method, map[string]interface{}{"ids": ids}, nil)
+}
+
+func remove(d *daemon, args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	deleteData := fs.Bool("delete-data", false, "also delete the downloaded files")
+	fs.Parse(args)
+
+	ids, err := parseIDs(fs.Args())
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no torrent ids given")
+	}
+	return d.call("torrent-remove", map[string]interface{}{
+		"ids":               ids,
+		"delete-local-data": *deleteData,
+	}, nil)
+}
+
+// verify rechecks torrents of the daemon by id, or a .torrent file's data locally
+func verify(d *daemon, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("dir", ".", "directory holding the data of a .torrent file")
+	fs.Parse(args)
+
+	if fs.NArg() == 1 {
+		if _, err := strconv.Atoi(fs.Arg(0)); err != nil {
+			metainfo, err := os.ReadFile(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+
+			good, total, err := backend.VerifyMetainfo(metainfo, *dir)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d of %d pieces good\n", good, total)
+			if good != total {
+				os.Exit(1)
+			}
+			return nil
+		}
+	}
+	return each(d, "torrent-verify", fs.Args())
+}
+
+func create(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	announce := fs.String("announce", "", "tracker announce URL")
+	pieceLength := fs.Int("piece-length", 0, "piece length in bytes, picked from the size when 0")
+	output := fs.String("o", "", "output file, <name>.torrent by default")
+	private := fs.Bool("private", false, "only let clients find peers through the tracker")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("create takes a single file or directory")
+	}
+
+	metainfo, err := backend.CreateTorrent(fs.Arg(0), *announce, *pieceLength, *private)
+	if err != nil {
+		return err
+	}
+
+	out := *output
+	if out == "" {
+		out = strings.TrimRight(fs.Arg(0), "/\\") + ".torrent"
+	}
+	err = os.WriteFile(out, metainfo, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Created", out)
+	return nil
+}
+
+func parseIDs(args []string) ([]int, error) {
+	ids := make([]int, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid torrent id %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// sessionHeader is the Transmission CSRF header the daemon hands out
+const sessionHeader = "X-Transmission-Session-Id"
+
+// daemon talks to gorrentd's Transmission RPC over its unix socket
+type daemon struct {
+	client    *http.Client
+	sessionID string
+}
+
+func newDaemon(socket string) *daemon {
+	dialer := &net.Dialer{}
+	return &daemon{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+type rpcResponse struct {
+	Result    string          `json:"result"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// call runs an RPC method and decodes its arguments into result, if not nil
+func (d *daemon) call(method string, args interface{}, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"method":    method,
+		"arguments": args,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.post(body)
+	if err != nil {
+		return err
+	}
+	// the first request only fetches the session id
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		d.sessionID = resp.Header.Get(sessionHeader)
+		resp, err = d.post(body)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon replied %s", resp.Status)
+	}
+
+	var rpcResp rpcResponse
+	err = json.NewDecoder(resp.Body).Decode(&rpcResp)
+	if err != nil {
+		return err
+	}
+	if rpcResp.Result != "success" {
+		return fmt.Errorf("%s", rpcResp.Result)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(rpcResp.Arguments, result)
+}
+
+func (d *daemon) post(body []byte) (*http.Response, error) {
+	// the host is ignored, the transport always dials the socket
+	req, err := http.NewRequest(http.MethodPost, "http://gorrentd/transmission/rpc", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(sessionHeader, d.sessionID)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't reach gorrentd, is it running? %w", err)
+	}
+	return resp, nil
+}
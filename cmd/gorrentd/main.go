@@ -0,0 +1,195 @@
+// gorrentd runs the gorrent session engine without the Wails window
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gorrent/backend"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Config is read from the JSON file given with -config. Missing fields keep
+// the backend defaults.
+type Config struct {
+	Database     string                      `json:"database"`
+	DownloadDir  string                      `json:"downloadDir"`
+	StreamAddr   string                      `json:"streamAddr"`
+	Socket       string                      `json:"socket"`
+	ListenPort   int                         `json:"listenPort"`
+	Encryption   string                      `json:"encryption"`
+	DisableUTP   bool                        `json:"disableUTP"`
+	Torrents     []string                    `json:"torrents"`
+	Bandwidth    *backend.BandwidthSettings  `json:"bandwidth"`
+	Queue        *backend.QueueSettings      `json:"queue"`
+	SeedingGoals *backend.SeedingGoals       `json:"seedingGoals"`
+	Connections  *backend.ConnectionSettings `json:"connections"`
+	IPFilter     string                      `json:"ipFilter"`
+	RPC          *RPCConfig                  `json:"rpc"`
+	WebUI        *RPCConfig                  `json:"webui"`
+}
+
+// RPCConfig enables the Transmission RPC or the qBittorrent WebUI API. Addr
+// defaults to 127.0.0.1:9091 and 127.0.0.1:8080. Leaving the username empty
+// turns authentication off, which is only allowed on a loopback address.
+type RPCConfig struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) apply() error {
+	if cfg.Database != "" {
+		backend.DatabasePath = cfg.Database
+	}
+	if cfg.DownloadDir != "" {
+		backend.DownloadDir = cfg.DownloadDir
+	}
+	if cfg.StreamAddr != "" {
+		backend.StreamAddr = cfg.StreamAddr
+	}
+	if cfg.Socket != "" {
+		backend.SocketPath = cfg.Socket
+	}
+	if cfg.ListenPort != 0 {
+		backend.ListenPort = cfg.ListenPort
+	}
+	if cfg.DisableUTP {
+		backend.UTPEnabled = false
+	}
+	if cfg.Encryption != "" {
+		err := backend.SetEncryptionPolicy(cfg.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Bandwidth != nil {
+		err := backend.SetBandwidthSettings(*cfg.Bandwidth)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Queue != nil {
+		err := backend.SetQueueSettings(*cfg.Queue)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.SeedingGoals != nil {
+		err := backend.SetSeedingGoals(*cfg.SeedingGoals)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Connections != nil {
+		err := backend.SetConnectionSettings(*cfg.Connections)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.IPFilter != "" {
+		err := backend.SetIPFilter(cfg.IPFilter)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+
+	err = cfg.apply()
+	if err != nil {
+		fmt.Println("Error applying config:", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	events := backend.NewChannelPublisher(64)
+	backend.Subscribe(events, backend.FilterTypes(backend.EventTorrentState))
+	go logEvents(events)
+
+	err = backend.StartSession(ctx)
+	if err != nil {
+		fmt.Println("Error resuming torrents:", err)
+	}
+
+	err = backend.StartControlSocket(backend.SocketPath)
+	if err != nil {
+		fmt.Println("Error starting control socket:", err)
+		os.Exit(1)
+	}
+	defer os.Remove(backend.SocketPath)
+
+	if cfg.RPC != nil {
+		err = backend.StartTransmissionRPC(cfg.RPC.Addr, cfg.RPC.Username, cfg.RPC.Password)
+		if err != nil {
+			fmt.Println("Error starting Transmission RPC:", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.WebUI != nil {
+		err = backend.StartQBittorrentAPI(cfg.WebUI.Addr, cfg.WebUI.Username, cfg.WebUI.Password)
+		if err != nil {
+			fmt.Println("Error starting qBittorrent API:", err)
+			os.Exit(1)
+		}
+	}
+
+	// torrents given on the command line or in the config are added once,
+	// adding them again on the next start is a no-op
+	for _, path := range append(cfg.Torrents, flag.Args()...) {
+		t, err := backend.HandleFile(ctx, path)
+		if err != nil {
+			fmt.Printf("Error adding %s: %v\n", path, err)
+			continue
+		}
+		backend.Enqueue(t)
+		fmt.Println("Added", t.TorrentName)
+	}
+
+	<-ctx.Done()
+	fmt.Println("Shutting down")
+	backend.Shutdown()
+}
+
+// logEvents prints torrent state changes
+func logEvents(events *backend.ChannelPublisher) {
+	for e := range events.C {
+		state := e.Data.(backend.StateEvent)
+		fmt.Printf("Torrent %d is now %s\n", e.TorrentID, state.Status)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"context"
+	"gorrent/backend"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// wailsPublisher forwards backend events to the frontend, named after their type
+type wailsPublisher struct {
+	ctx context.Context
+}
+
+func (p wailsPublisher) Publish(e backend.Event) {
+	runtime.EventsEmit(p.ctx, string(e.Type), e)
+}
@@ -4,10 +4,62 @@ import {backend} from '../models';
 
 export function AddTorrent(arg1:backend.Torrent):Promise<void>;
 
+export function GetBandwidthSettings():Promise<backend.BandwidthSettings>;
+
+export function GetConnectionSettings():Promise<backend.ConnectionSettings>;
+
 export function GetDevTorrent():Promise<backend.Torrent>;
 
+export function GetEncryptionPolicy():Promise<string>;
+
+export function GetIPFilter():Promise<backend.IPFilterStatus>;
+
+export function GetPeers(arg1:number):Promise<Array<backend.PeerInfo>>;
+
+export function GetQueueSettings():Promise<backend.QueueSettings>;
+
+export function GetSeedingGoals():Promise<backend.SeedingGoals>;
+
+export function GetStats():Promise<Array<backend.TorrentStats>>;
+
+export function GetStreamURL(arg1:number,arg2:number):Promise<string>;
+
 export function GetTorrents():Promise<Array<backend.Torrent>>;
 
+export function MoveQueueBottom(arg1:number):Promise<void>;
+
+export function MoveQueueDown(arg1:number):Promise<void>;
+
+export function MoveQueueTop(arg1:number):Promise<void>;
+
+export function MoveQueueUp(arg1:number):Promise<void>;
+
 export function OpenFileDialog():Promise<backend.Torrent>;
 
+export function PauseTorrent(arg1:number):Promise<void>;
+
+export function ReloadIPFilter():Promise<void>;
+
 export function RemoveTorrent(arg1:number):Promise<void>;
+
+export function ResumeTorrent(arg1:number):Promise<void>;
+
+export function SetBandwidthSettings(arg1:backend.BandwidthSettings):Promise<void>;
+
+export function SetConnectionSettings(arg1:backend.ConnectionSettings):Promise<void>;
+
+export function SetEncryptionPolicy(arg1:string):Promise<void>;
+
+export function SetFilePriority(arg1:number,arg2:number,arg3:number):Promise<void>;
+
+export function SetIPFilter(arg1:string):Promise<void>;
+
+export function SetQueueSettings(arg1:backend.QueueSettings):Promise<void>;
+
+export function SetSeedingGoals(arg1:backend.SeedingGoals):Promise<void>;
+
+export function SetSequential(arg1:number,arg2:boolean):Promise<void>;
+
+export function SetTorrentBandwidth(arg1:number,arg2:number,arg3:number):Promise<void>;
+
+export function SetTorrentSeedingGoals(arg1:number,arg2:backend.SeedingGoals):Promise<void>;
@@ -6,18 +6,122 @@ export function AddTorrent(arg1) {
   return window['go']['main']['App']['AddTorrent'](arg1);
 }
 
+export function GetBandwidthSettings() {
+  return window['go']['main']['App']['GetBandwidthSettings']();
+}
+
+export function GetConnectionSettings() {
+  return window['go']['main']['App']['GetConnectionSettings']();
+}
+
 export function GetDevTorrent() {
   return window['go']['main']['App']['GetDevTorrent']();
 }
 
+export function GetEncryptionPolicy() {
+  return window['go']['main']['App']['GetEncryptionPolicy']();
+}
+
+export function GetIPFilter() {
+  return window['go']['main']['App']['GetIPFilter']();
+}
+
+export function GetPeers(arg1) {
+  return window['go']['main']['App']['GetPeers'](arg1);
+}
+
+export function GetQueueSettings() {
+  return window['go']['main']['App']['GetQueueSettings']();
+}
+
+export function GetSeedingGoals() {
+  return window['go']['main']['App']['GetSeedingGoals']();
+}
+
+export function GetStats() {
+  return window['go']['main']['App']['GetStats']();
+}
+
+export function GetStreamURL(arg1, arg2) {
+  return window['go']['main']['App']['GetStreamURL'](arg1, arg2);
+}
+
 export function GetTorrents() {
   return window['go']['main']['App']['GetTorrents']();
 }
 
+export function MoveQueueBottom(arg1) {
+  return window['go']['main']['App']['MoveQueueBottom'](arg1);
+}
+
+export function MoveQueueDown(arg1) {
+  return window['go']['main']['App']['MoveQueueDown'](arg1);
+}
+
+export function MoveQueueTop(arg1) {
+  return window['go']['main']['App']['MoveQueueTop'](arg1);
+}
+
+export function MoveQueueUp(arg1) {
+  return window['go']['main']['App']['MoveQueueUp'](arg1);
+}
+
 export function OpenFileDialog() {
   return window['go']['main']['App']['OpenFileDialog']();
 }
 
+export function PauseTorrent(arg1) {
+  return window['go']['main']['App']['PauseTorrent'](arg1);
+}
+
+export function ReloadIPFilter() {
+  return window['go']['main']['App']['ReloadIPFilter']();
+}
+
 export function RemoveTorrent(arg1) {
   return window['go']['main']['App']['RemoveTorrent'](arg1);
 }
+
+export function ResumeTorrent(arg1) {
+  return window['go']['main']['App']['ResumeTorrent'](arg1);
+}
+
+export function SetBandwidthSettings(arg1) {
+  return window['go']['main']['App']['SetBandwidthSettings'](arg1);
+}
+
+export function SetConnectionSettings(arg1) {
+  return window['go']['main']['App']['SetConnectionSettings'](arg1);
+}
+
+export function SetEncryptionPolicy(arg1) {
+  return window['go']['main']['App']['SetEncryptionPolicy'](arg1);
+}
+
+export function SetFilePriority(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SetFilePriority'](arg1, arg2, arg3);
+}
+
+export function SetIPFilter(arg1) {
+  return window['go']['main']['App']['SetIPFilter'](arg1);
+}
+
+export function SetQueueSettings(arg1) {
+  return window['go']['main']['App']['SetQueueSettings'](arg1);
+}
+
+export function SetSeedingGoals(arg1) {
+  return window['go']['main']['App']['SetSeedingGoals'](arg1);
+}
+
+export function SetSequential(arg1, arg2) {
+  return window['go']['main']['App']['SetSequential'](arg1, arg2);
+}
+
+export function SetTorrentBandwidth(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SetTorrentBandwidth'](arg1, arg2, arg3);
+}
+
+export function SetTorrentSeedingGoals(arg1, arg2) {
+  return window['go']['main']['App']['SetTorrentSeedingGoals'](arg1, arg2);
+}
@@ -1,5 +1,141 @@
 export namespace backend {
 	
+	export class BandwidthSettings {
+	    downloadLimit: number;
+	    uploadLimit: number;
+	    peerDownloadLimit: number;
+	    peerUploadLimit: number;
+	    altDownloadLimit: number;
+	    altUploadLimit: number;
+	    altEnabled: boolean;
+	    altScheduleEnabled: boolean;
+	    altFrom: number;
+	    altTo: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new BandwidthSettings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.downloadLimit = source["downloadLimit"];
+	        this.uploadLimit = source["uploadLimit"];
+	        this.peerDownloadLimit = source["peerDownloadLimit"];
+	        this.peerUploadLimit = source["peerUploadLimit"];
+	        this.altDownloadLimit = source["altDownloadLimit"];
+	        this.altUploadLimit = source["altUploadLimit"];
+	        this.altEnabled = source["altEnabled"];
+	        this.altScheduleEnabled = source["altScheduleEnabled"];
+	        this.altFrom = source["altFrom"];
+	        this.altTo = source["altTo"];
+	    }
+	}
+	export class ConnectionSettings {
+	    maxConnections: number;
+	    maxConnectionsPerTorrent: number;
+	    maxHalfOpen: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new ConnectionSettings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.maxConnections = source["maxConnections"];
+	        this.maxConnectionsPerTorrent = source["maxConnectionsPerTorrent"];
+	        this.maxHalfOpen = source["maxHalfOpen"];
+	    }
+	}
+	export class IPFilterStatus {
+	    path: string;
+	    ranges: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new IPFilterStatus(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.path = source["path"];
+	        this.ranges = source["ranges"];
+	    }
+	}
+	export class PeerInfo {
+	    address: string;
+	    peerId: string;
+	    client: string;
+	    progress: number;
+	    downloadRate: number;
+	    uploadRate: number;
+	    downloaded: number;
+	    uploaded: number;
+	    outstandingRequests: number;
+	    direction: string;
+	    encrypted: boolean;
+	    source: string;
+	    transport: string;
+	    clientChoked: boolean;
+	    peerChoked: boolean;
+	    clientInterested: boolean;
+	    peerInterested: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new PeerInfo(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.address = source["address"];
+	        this.peerId = source["peerId"];
+	        this.client = source["client"];
+	        this.progress = source["progress"];
+	        this.downloadRate = source["downloadRate"];
+	        this.uploadRate = source["uploadRate"];
+	        this.downloaded = source["downloaded"];
+	        this.uploaded = source["uploaded"];
+	        this.outstandingRequests = source["outstandingRequests"];
+	        this.direction = source["direction"];
+	        this.encrypted = source["encrypted"];
+	        this.source = source["source"];
+	        this.transport = source["transport"];
+	        this.clientChoked = source["clientChoked"];
+	        this.peerChoked = source["peerChoked"];
+	        this.clientInterested = source["clientInterested"];
+	        this.peerInterested = source["peerInterested"];
+	    }
+	}
+	export class QueueSettings {
+	    maxActiveDownloads: number;
+	    maxActiveSeeds: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new QueueSettings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.maxActiveDownloads = source["maxActiveDownloads"];
+	        this.maxActiveSeeds = source["maxActiveSeeds"];
+	    }
+	}
+	export class SeedingGoals {
+	    ratio: number;
+	    seedingTime: number;
+	    idleTime: number;
+	    action: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new SeedingGoals(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.ratio = source["ratio"];
+	        this.seedingTime = source["seedingTime"];
+	        this.idleTime = source["idleTime"];
+	        this.action = source["action"];
+	    }
+	}
 	export class Torrent {
 	    id: number;
 	    torrentName: string;
@@ -8,6 +144,17 @@ export namespace backend {
 	    isMultiFile: boolean;
 	    totalLength: number;
 	    status: string;
+	    filePriorities: number[];
+	    sequential: boolean;
+	    downloadLimit: number;
+	    uploadLimit: number;
+	    queuePosition: number;
+	    uploaded: number;
+	    downloaded: number;
+	    ratio: number;
+	    seedingTime: number;
+	    seedingGoals?: SeedingGoals;
+	    private: boolean;
 	
 	    static createFrom(source: any = {}) {
 	        return new Torrent(source);
@@ -22,6 +169,67 @@ export namespace backend {
 	        this.isMultiFile = source["isMultiFile"];
 	        this.totalLength = source["totalLength"];
 	        this.status = source["status"];
+	        this.filePriorities = source["filePriorities"];
+	        this.sequential = source["sequential"];
+	        this.downloadLimit = source["downloadLimit"];
+	        this.uploadLimit = source["uploadLimit"];
+	        this.queuePosition = source["queuePosition"];
+	        this.uploaded = source["uploaded"];
+	        this.downloaded = source["downloaded"];
+	        this.ratio = source["ratio"];
+	        this.seedingTime = source["seedingTime"];
+	        this.seedingGoals = this.convertValues(source["seedingGoals"], SeedingGoals);
+	        this.private = source["private"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class TorrentStats {
+	    id: number;
+	    progress: number;
+	    downloadSpeed: number;
+	    uploadSpeed: number;
+	    eta: number;
+	    peers: number;
+	    totalPeers: number;
+	    seeds: number;
+	    totalSeeds: number;
+	    availability: number;
+	    wasted: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new TorrentStats(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.progress = source["progress"];
+	        this.downloadSpeed = source["downloadSpeed"];
+	        this.uploadSpeed = source["uploadSpeed"];
+	        this.eta = source["eta"];
+	        this.peers = source["peers"];
+	        this.totalPeers = source["totalPeers"];
+	        this.seeds = source["seeds"];
+	        this.totalSeeds = source["totalSeeds"];
+	        this.availability = source["availability"];
+	        this.wasted = source["wasted"];
 	    }
 	}
 
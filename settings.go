@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorrent/backend"
+	"os"
+)
+
+// settingsPath is where the app keeps the settings it restores on startup
+var settingsPath = "./gorrent-settings.json"
+
+// appSettings are the GUI settings that outlive a session, named like
+// gorrentd's config. Missing ones keep the backend defaults.
+type appSettings struct {
+	Bandwidth    *backend.BandwidthSettings  `json:"bandwidth,omitempty"`
+	Queue        *backend.QueueSettings      `json:"queue,omitempty"`
+	SeedingGoals *backend.SeedingGoals       `json:"seedingGoals,omitempty"`
+	Connections  *backend.ConnectionSettings `json:"connections,omitempty"`
+	Encryption   string                      `json:"encryption,omitempty"`
+	IPFilter     string                      `json:"ipFilter"`
+}
+
+// apply hands the saved settings to the backend before the session starts.
+// A setting that fails is reported and the others still apply.
+func (s *appSettings) apply() {
+	if s.Bandwidth != nil {
+		err := backend.SetBandwidthSettings(*s.Bandwidth)
+		if err != nil {
+			fmt.Println("Error restoring bandwidth settings:", err)
+		}
+	}
+	if s.Queue != nil {
+		err := backend.SetQueueSettings(*s.Queue)
+		if err != nil {
+			fmt.Println("Error restoring queue settings:", err)
+		}
+	}
+	if s.SeedingGoals != nil {
+		err := backend.SetSeedingGoals(*s.SeedingGoals)
+		if err != nil {
+			fmt.Println("Error restoring seeding goals:", err)
+		}
+	}
+	if s.Connections != nil {
+		err := backend.SetConnectionSettings(*s.Connections)
+		if err != nil {
+			fmt.Println("Error restoring connection settings:", err)
+		}
+	}
+	if s.Encryption != "" {
+		err := backend.SetEncryptionPolicy(s.Encryption)
+		if err != nil {
+			fmt.Println("Error restoring encryption policy:", err)
+		}
+	}
+	if s.IPFilter != "" {
+		err := backend.SetIPFilter(s.IPFilter)
+		if err != nil {
+			fmt.Println("Error loading IP filter:", err)
+		}
+	}
+}
+
+// loadSettings reads the saved settings, a missing file meaning defaults
+func loadSettings() (appSettings, error) {
+	var settings appSettings
+	data, err := os.ReadFile(settingsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	err = json.Unmarshal(data, &settings)
+	return settings, err
+}
+
+// updateSettings applies change to the saved settings and writes them back
+func updateSettings(change func(*appSettings)) error {
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	change(&settings)
+
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(settingsPath, data, 0644)
+}